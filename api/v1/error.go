@@ -2,8 +2,10 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -34,3 +36,282 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrQuotaExceeded is returned when appending a record would take the log
+// past its byte quota or its disk below the configured free space floor.
+type ErrQuotaExceeded struct {
+	Requested uint64
+	Available uint64
+}
+
+func (e ErrQuotaExceeded) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("Log quota exceeded: %d bytes requested, %d available", e.Requested, e.Available),
+	)
+	msg := fmt.Sprintf(
+		"The log is out of space for %d more bytes, try again once old records are removed",
+		e.Requested,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownProducer is returned when producing with a producer ID that wasn't
+// handed out by InitProducer, or that expired after its records were truncated.
+type ErrUnknownProducer struct {
+	ProducerID uint64
+}
+
+func (e ErrUnknownProducer) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("Unknown producer: %d", e.ProducerID),
+	)
+	msg := fmt.Sprintf(
+		"Producer %d isn't registered, call InitProducer for a producer ID",
+		e.ProducerID,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownProducer) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOutOfOrderSequence is returned when a producer's record skips ahead of the
+// sequence number expected from it next, meaning records in between were lost,
+// or repeats one too old to tell where it was appended.
+type ErrOutOfOrderSequence struct {
+	ProducerID uint64
+	Expected   uint64
+	Sequence   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"Out of order sequence for producer %d: expected %d, got %d",
+			e.ProducerID, e.Expected, e.Sequence,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The log expected sequence %d from producer %d but got %d",
+		e.Expected, e.ProducerID, e.Sequence,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnexpectedOffset is returned by a conditional append when the log's next
+// offset isn't the one the writer expected, because something else was
+// appended since it last looked.
+type ErrUnexpectedOffset struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrUnexpectedOffset) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("Unexpected offset: expected %d, got %d", e.Expected, e.Actual),
+	)
+	msg := fmt.Sprintf(
+		"The log's next offset is %d rather than the expected %d",
+		e.Actual, e.Expected,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	// The offsets are also given in a form clients can parse
+	info := &errdetails.ErrorInfo{
+		Reason: "UNEXPECTED_OFFSET",
+		Domain: "yojimbo",
+		Metadata: map[string]string{
+			"expected_offset": strconv.FormatUint(e.Expected, 10),
+			"actual_offset":   strconv.FormatUint(e.Actual, 10),
+		},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnexpectedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnexpectedVersion is returned by a conditional append when the next
+// version of the record's stream isn't the one the writer expected.
+type ErrUnexpectedVersion struct {
+	Key      string
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrUnexpectedVersion) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"Unexpected version of %q: expected %d, got %d",
+			e.Key, e.Expected, e.Actual,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The next version of stream %q is %d rather than the expected %d",
+		e.Key, e.Actual, e.Expected,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason: "UNEXPECTED_VERSION",
+		Domain: "yojimbo",
+		Metadata: map[string]string{
+			"key":              e.Key,
+			"expected_version": strconv.FormatUint(e.Expected, 10),
+			"actual_version":   strconv.FormatUint(e.Actual, 10),
+		},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnexpectedVersion) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownTxn is returned when writing to or ending a transaction that
+// wasn't begun or has already ended.
+type ErrUnknownTxn struct {
+	TxnID uint64
+}
+
+func (e ErrUnknownTxn) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("Unknown transaction: %d", e.TxnID),
+	)
+	msg := fmt.Sprintf(
+		"Transaction %d isn't open, call BeginTxn to start one",
+		e.TxnID,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownTxn) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownMember is returned for a consumer group member that never joined
+// the group or whose session timed out.
+type ErrUnknownMember struct {
+	Group    string
+	MemberID string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("Unknown member of group %q: %q", e.Group, e.MemberID),
+	)
+	msg := fmt.Sprintf(
+		"%q isn't a member of group %q, call JoinGroup to join it",
+		e.MemberID, e.Group,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrIllegalGeneration is returned when a consumer group member commits an
+// offset with a generation the group has moved on from, as its partitions may
+// have been assigned to another member since.
+type ErrIllegalGeneration struct {
+	Group      string
+	Generation uint64
+	Current    uint64
+}
+
+func (e ErrIllegalGeneration) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"Illegal generation of group %q: %d, current is %d",
+			e.Group, e.Generation, e.Current,
+		),
+	)
+	msg := fmt.Sprintf(
+		"Group %q is in generation %d rather than %d, heartbeat for the current assignment",
+		e.Group, e.Current, e.Generation,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrIllegalGeneration) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,61 @@
+package group
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssign(t *testing.T) {
+	members := func(ids ...string) []*member {
+		var ms []*member
+		for _, id := range ids {
+			ms = append(ms, &member{id: id, logs: []string{"a", "b"}})
+		}
+		return ms
+	}
+	partitions := []Partition{
+		{"a", 0}, {"a", 1}, {"a", 2}, {"b", 0}, {"b", 1},
+	}
+
+	a := assign(Range, members("m1", "m2"), partitions, nil)
+	require.Equal(t, assignment{
+		{"a", 0}: "m1", {"a", 1}: "m1", {"a", 2}: "m2",
+		{"b", 0}: "m1", {"b", 1}: "m2",
+	}, a)
+
+	a = assign(RoundRobin, members("m1", "m2"), partitions, nil)
+	require.Equal(t, assignment{
+		{"a", 0}: "m1", {"a", 1}: "m2", {"a", 2}: "m1",
+		{"b", 0}: "m2", {"b", 1}: "m1",
+	}, a)
+
+	// A new member only takes partitions off the others
+	prev := a
+	a = assign(Sticky, members("m1", "m2", "m3"), partitions, prev)
+	moved := 0
+	counts := make(map[string]int)
+	for p, id := range a {
+		counts[id]++
+		if prev[p] != id {
+			moved++
+			require.Equal(t, "m3", id)
+		}
+	}
+	require.Equal(t, 1, moved)
+	require.Equal(t, map[string]int{"m1": 2, "m2": 2, "m3": 1}, counts)
+}
+
+func TestAssignSubscriptions(t *testing.T) {
+	ms := []*member{
+		{id: "m1", logs: []string{"a"}},
+		{id: "m2", logs: []string{"b"}},
+	}
+	partitions := []Partition{{"a", 0}, {"a", 1}, {"b", 0}}
+	for _, s := range []Strategy{Range, RoundRobin, Sticky} {
+		a := assign(s, ms, partitions, nil)
+		require.Equal(t, assignment{
+			{"a", 0}: "m1", {"a", 1}: "m1", {"b", 0}: "m2",
+		}, a, "strategy %d", s)
+	}
+}
@@ -0,0 +1,135 @@
+package group
+
+import (
+	"sort"
+)
+
+// Strategy is how a group's partitions are assigned to its members.
+type Strategy int
+
+const (
+	// Range gives each member a contiguous range of each log's partitions.
+	Range Strategy = iota
+	// RoundRobin deals all the partitions out to the members in turn.
+	RoundRobin
+	// Sticky balances the partitions while moving as few as it can from
+	// the member that had them in the last generation.
+	Sticky
+)
+
+// Partition is a log partition a member is assigned.
+type Partition struct {
+	Log       string
+	Partition uint32
+}
+
+// assignment maps each partition to the member assigned it.
+type assignment map[Partition]string
+
+// assign assigns partitions to members, which are sorted by ID. prev is the
+// last generation's assignment.
+func assign(s Strategy, members []*member, partitions []Partition, prev assignment) assignment {
+	switch s {
+	case RoundRobin:
+		return assignRoundRobin(members, partitions)
+	case Sticky:
+		return assignSticky(members, partitions, prev)
+	default:
+		return assignRange(members, partitions)
+	}
+}
+
+func assignRange(members []*member, partitions []Partition) assignment {
+	a := make(assignment)
+	byLog := make(map[string][]Partition)
+	for _, p := range partitions {
+		byLog[p.Log] = append(byLog[p.Log], p)
+	}
+	for log, ps := range byLog {
+		var eligible []*member
+		for _, m := range members {
+			if m.subscribes(log) {
+				eligible = append(eligible, m)
+			}
+		}
+		if len(eligible) == 0 {
+			continue
+		}
+		n, extra := len(ps)/len(eligible), len(ps)%len(eligible)
+		i := 0
+		for j, m := range eligible {
+			count := n
+			if j < extra {
+				count++
+			}
+			for _, p := range ps[i : i+count] {
+				a[p] = m.id
+			}
+			i += count
+		}
+	}
+	return a
+}
+
+func assignRoundRobin(members []*member, partitions []Partition) assignment {
+	a := make(assignment)
+	next := 0
+	for _, p := range partitions {
+		for i := 0; i < len(members); i++ {
+			m := members[(next+i)%len(members)]
+			if m.subscribes(p.Log) {
+				a[p] = m.id
+				next = (next + i + 1) % len(members)
+				break
+			}
+		}
+	}
+	return a
+}
+
+func assignSticky(members []*member, partitions []Partition, prev assignment) assignment {
+	a := make(assignment)
+	byID := make(map[string]*member, len(members))
+	for _, m := range members {
+		byID[m.id] = m
+	}
+	// No member should hold more than its share
+	max := (len(partitions) + len(members) - 1) / len(members)
+	counts := make(map[string]int)
+	var unassigned []Partition
+	for _, p := range partitions {
+		id, ok := prev[p]
+		if m := byID[id]; ok && m != nil && m.subscribes(p.Log) && counts[id] < max {
+			a[p] = id
+			counts[id]++
+			continue
+		}
+		unassigned = append(unassigned, p)
+	}
+	for _, p := range unassigned {
+		var least *member
+		for _, m := range members {
+			if !m.subscribes(p.Log) {
+				continue
+			}
+			if least == nil || counts[m.id] < counts[least.id] {
+				least = m
+			}
+		}
+		if least != nil {
+			a[p] = least.id
+			counts[least.id]++
+		}
+	}
+	return a
+}
+
+// sortPartitions sorts partitions by log and then partition.
+func sortPartitions(ps []Partition) {
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].Log != ps[j].Log {
+			return ps[i].Log < ps[j].Log
+		}
+		return ps[i].Partition < ps[j].Partition
+	})
+}
@@ -0,0 +1,65 @@
+package group
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestCoordinator(t *testing.T) {
+	now := time.Now()
+	c := NewCoordinator(Config{
+		SessionTimeout: time.Second,
+		Partitions: func(log string) (uint32, bool) {
+			return 2, log == "orders"
+		},
+	})
+	c.now = func() time.Time { return now }
+
+	_, err := c.Join("billing", "", []string{"missing"}, Range, 0)
+	require.True(t, errors.Is(err, ErrUnknownLog), "got %v", err)
+
+	m1, err := c.Join("billing", "", []string{"orders"}, RoundRobin, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), m1.Generation)
+	require.Equal(t, []Partition{{"orders", 0}, {"orders", 1}}, m1.Partitions)
+
+	m2, err := c.Join("billing", "", []string{"orders"}, RoundRobin, 3*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), m2.Generation)
+	require.Equal(t, []Partition{{"orders", 1}}, m2.Partitions)
+
+	// The first member learns of the rebalance from its heartbeat and its
+	// commits with the old generation are fenced
+	err = c.Validate("billing", m1.MemberID, m1.Generation)
+	require.Equal(t, api.ErrIllegalGeneration{Group: "billing", Generation: 1, Current: 2}, err)
+	m1, err = c.Heartbeat("billing", m1.MemberID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), m1.Generation)
+	require.Equal(t, []Partition{{"orders", 0}}, m1.Partitions)
+	require.NoError(t, c.Validate("billing", m1.MemberID, m1.Generation))
+	require.Equal(t, []Membership{m1, m2}, c.Describe("billing"))
+
+	// Rejoining with the same subscription doesn't rebalance
+	m1, err = c.Join("billing", m1.MemberID, []string{"orders"}, RoundRobin, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), m1.Generation)
+
+	// The first member's session times out, and the second takes over
+	now = now.Add(2 * time.Second)
+	m2, err = c.Heartbeat("billing", m2.MemberID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), m2.Generation)
+	require.Equal(t, []Partition{{"orders", 0}, {"orders", 1}}, m2.Partitions)
+	_, err = c.Heartbeat("billing", m1.MemberID)
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: m1.MemberID}, err)
+
+	require.NoError(t, c.Leave("billing", m2.MemberID))
+	require.Nil(t, c.Describe("billing"))
+	// Commits to a group without members aren't fenced
+	require.NoError(t, c.Validate("billing", "", 0))
+}
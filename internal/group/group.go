@@ -0,0 +1,274 @@
+// Package group coordinates consumer groups: it tracks each group's live
+// members and assigns them the partitions of the logs they subscribe to, so
+// that a group's consumers share the work of reading them.
+//
+// Every change in a group's membership starts a new generation with a new
+// assignment. Members learn of it from their heartbeats, and offsets committed
+// with an older generation are refused, so a member that fell out of the group
+// can't overwrite the progress of the one that took over its partitions.
+package group
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// ErrUnknownLog is returned when joining a group with a subscription to a log
+// that doesn't exist.
+var ErrUnknownLog = errors.New("unknown log")
+
+type Config struct {
+	// SessionTimeout is how long a member stays in its group without a
+	// heartbeat, unless it asks for another timeout when joining.
+	// Defaults to 10s.
+	SessionTimeout time.Duration
+	// Partitions returns the number of partitions of a log, or false if
+	// there's no such log.
+	Partitions func(log string) (uint32, bool)
+}
+
+// Membership is a member's place in its group's current generation.
+type Membership struct {
+	MemberID   string
+	Generation uint64
+	// Partitions are the partitions assigned to the member, sorted.
+	Partitions []Partition
+}
+
+type member struct {
+	id       string
+	logs     []string
+	timeout  time.Duration
+	lastSeen time.Time
+}
+
+func (m *member) subscribes(log string) bool {
+	for _, l := range m.logs {
+		if l == log {
+			return true
+		}
+	}
+	return false
+}
+
+type group struct {
+	strategy   Strategy
+	generation uint64
+	members    map[string]*member
+	assignment assignment
+}
+
+// Coordinator tracks the members of consumer groups. Groups only live in
+// memory: after a restart members rejoin, starting new generations.
+type Coordinator struct {
+	mu     sync.Mutex
+	Config Config
+	groups map[string]*group
+	nextID uint64
+	// now is the clock sessions are timed by.
+	now func() time.Time
+}
+
+func NewCoordinator(c Config) *Coordinator {
+	if c.SessionTimeout == 0 {
+		c.SessionTimeout = 10 * time.Second
+	}
+	return &Coordinator{
+		Config: c,
+		groups: make(map[string]*group),
+		now:    time.Now,
+	}
+}
+
+// Join adds a member subscribing to logs to the group, or updates the
+// subscription of an existing member if memberID is set. The group's strategy
+// is the one its first member joined with. A timeout of zero takes the
+// configured session timeout.
+func (c *Coordinator) Join(groupID, memberID string, logs []string, strategy Strategy, timeout time.Duration) (Membership, error) {
+	for _, log := range logs {
+		if _, ok := c.Config.Partitions(log); !ok {
+			return Membership{}, fmt.Errorf("%w: %q", ErrUnknownLog, log)
+		}
+	}
+	if timeout == 0 {
+		timeout = c.Config.SessionTimeout
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	g := c.group(groupID, now)
+	if g == nil {
+		g = &group{strategy: strategy, members: make(map[string]*member)}
+		c.groups[groupID] = g
+	}
+	m, ok := g.members[memberID]
+	if memberID != "" && !ok {
+		return Membership{}, api.ErrUnknownMember{Group: groupID, MemberID: memberID}
+	}
+	if !ok {
+		c.nextID++
+		m = &member{id: fmt.Sprintf("%s-%d", groupID, c.nextID)}
+		g.members[m.id] = m
+	}
+	m.timeout, m.lastSeen = timeout, now
+	logs = append([]string(nil), logs...)
+	sort.Strings(logs)
+	if !ok || !equal(m.logs, logs) {
+		m.logs = logs
+		c.rebalance(g)
+	}
+	return g.membership(m.id), nil
+}
+
+// Heartbeat keeps the member's session alive and returns its membership in
+// the group's current generation, which may have moved on since it last
+// looked.
+func (c *Coordinator) Heartbeat(groupID, memberID string) (Membership, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	g := c.group(groupID, now)
+	if g == nil || g.members[memberID] == nil {
+		return Membership{}, api.ErrUnknownMember{Group: groupID, MemberID: memberID}
+	}
+	g.members[memberID].lastSeen = now
+	return g.membership(memberID), nil
+}
+
+// Leave removes the member from the group, handing its partitions to the rest.
+func (c *Coordinator) Leave(groupID, memberID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g := c.group(groupID, c.now())
+	if g == nil || g.members[memberID] == nil {
+		return api.ErrUnknownMember{Group: groupID, MemberID: memberID}
+	}
+	delete(g.members, memberID)
+	c.rebalance(g)
+	return nil
+}
+
+// Describe returns the memberships of the group's members in its current
+// generation, sorted by member ID, or nil if it has no members.
+func (c *Coordinator) Describe(groupID string) []Membership {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g := c.group(groupID, c.now())
+	if g == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	memberships := make([]Membership, 0, len(ids))
+	for _, id := range ids {
+		memberships = append(memberships, g.membership(id))
+	}
+	return memberships
+}
+
+// Validate returns an error unless the member is in the group's current
+// generation, for fencing offset commits. Groups without members take commits
+// from anyone, so consumers that don't join one can still commit.
+func (c *Coordinator) Validate(groupID, memberID string, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g := c.group(groupID, c.now())
+	if g == nil {
+		if memberID != "" {
+			return api.ErrUnknownMember{Group: groupID, MemberID: memberID}
+		}
+		return nil
+	}
+	if g.members[memberID] == nil {
+		return api.ErrUnknownMember{Group: groupID, MemberID: memberID}
+	}
+	if generation != g.generation {
+		return api.ErrIllegalGeneration{Group: groupID, Generation: generation, Current: g.generation}
+	}
+	return nil
+}
+
+// group returns the group after removing the members whose sessions timed
+// out, or nil once it has no members left. The caller must hold c.mu.
+func (c *Coordinator) group(id string, now time.Time) *group {
+	g, ok := c.groups[id]
+	if !ok {
+		return nil
+	}
+	expired := false
+	for mid, m := range g.members {
+		if now.Sub(m.lastSeen) > m.timeout {
+			delete(g.members, mid)
+			expired = true
+		}
+	}
+	if len(g.members) == 0 {
+		delete(c.groups, id)
+		return nil
+	}
+	if expired {
+		c.rebalance(g)
+	}
+	return g
+}
+
+// rebalance starts a new generation, assigning the partitions of the logs the
+// members subscribe to. The caller must hold c.mu.
+func (c *Coordinator) rebalance(g *group) {
+	g.generation++
+	if len(g.members) == 0 {
+		g.assignment = nil
+		return
+	}
+	members := make([]*member, 0, len(g.members))
+	logs := make(map[string]bool)
+	for _, m := range g.members {
+		members = append(members, m)
+		for _, log := range m.logs {
+			logs[log] = true
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].id < members[j].id
+	})
+	var partitions []Partition
+	for log := range logs {
+		n, _ := c.Config.Partitions(log)
+		for p := uint32(0); p < n; p++ {
+			partitions = append(partitions, Partition{Log: log, Partition: p})
+		}
+	}
+	sortPartitions(partitions)
+	g.assignment = assign(g.strategy, members, partitions, g.assignment)
+}
+
+func (g *group) membership(memberID string) Membership {
+	m := Membership{MemberID: memberID, Generation: g.generation}
+	for p, id := range g.assignment {
+		if id == memberID {
+			m.Partitions = append(m.Partitions, p)
+		}
+	}
+	sortPartitions(m.Partitions)
+	return m
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
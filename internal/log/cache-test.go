@@ -0,0 +1,94 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestRecordCache(t *testing.T) {
+	rec := &api.Record{Value: []byte("hello world"), Offset: 1}
+	size := uint64(proto.Size(rec))
+	c := newRecordCache(size * 3)
+
+	for i := uint64(0); i < 4; i++ {
+		rec.Offset = i
+		c.Put(rec)
+	}
+	// Offset 0 was evicted to stay under maxBytes
+	_, ok := c.Get(0)
+	require.False(t, ok)
+	for i := uint64(1); i < 4; i++ {
+		got, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, got.Offset)
+		require.Equal(t, rec.Value, got.Value)
+	}
+
+	// Returned records are copies
+	got, _ := c.Get(1)
+	got.Value[0] = 'j'
+	got, _ = c.Get(1)
+	require.Equal(t, rec.Value, got.Value)
+
+	c.TruncateAfter(2)
+	_, ok = c.Get(3)
+	require.False(t, ok)
+	_, ok = c.Get(2)
+	require.True(t, ok)
+
+	// A gap in offsets restarts the cache
+	rec.Offset = 10
+	c.Put(rec)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	_, ok = c.Get(10)
+	require.True(t, ok)
+
+	c.Reset()
+	_, ok = c.Get(10)
+	require.False(t, ok)
+
+	// A nil cache is disabled
+	c = newRecordCache(0)
+	require.Nil(t, c)
+	c.Put(rec)
+	_, ok = c.Get(10)
+	require.False(t, ok)
+}
+
+func TestLogCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Cache.MaxBytes = 1024
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := &api.Record{Value: []byte("hello world")}
+	for i := uint64(0); i < 3; i++ {
+		offset, err := l.Append(append)
+		require.NoError(t, err)
+		require.Equal(t, i, offset)
+		cached, ok := l.cache.Get(offset)
+		require.True(t, ok)
+		read, err := l.Read(offset)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(cached, read))
+	}
+
+	// Truncated records are no longer served from the cache
+	require.NoError(t, l.Truncate(1))
+	_, err = l.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	require.NoError(t, l.TruncateAfter(2))
+	_, err = l.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+}
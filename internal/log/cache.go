@@ -0,0 +1,126 @@
+package log
+
+import (
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// recordCache keeps the most recently appended records decoded in memory so
+// that consumers tailing the log are served without touching the store. It
+// holds a contiguous run of offsets and evicts the oldest records once the
+// encoded size of its contents exceeds maxBytes.
+type recordCache struct {
+	mu       sync.Mutex
+	maxBytes uint64
+	size     uint64
+	base     uint64
+	entries  []cacheEntry
+}
+
+type cacheEntry struct {
+	rec  *api.Record
+	size uint64
+}
+
+// newRecordCache returns nil when maxBytes is 0, which disables caching since
+// every method is a no-op on a nil cache.
+func newRecordCache(maxBytes uint64) *recordCache {
+	if maxBytes == 0 {
+		return nil
+	}
+	return &recordCache{maxBytes: maxBytes}
+}
+
+// Put caches a copy of rec, which must have been assigned its offset.
+func (c *recordCache) Put(rec *api.Record) {
+	if c == nil {
+		return
+	}
+	size := uint64(proto.Size(rec))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size > c.maxBytes {
+		c.reset()
+		return
+	}
+	if len(c.entries) == 0 || rec.Offset != c.base+uint64(len(c.entries)) {
+		c.reset()
+		c.base = rec.Offset
+	}
+	c.entries = append(c.entries, cacheEntry{
+		rec:  proto.Clone(rec).(*api.Record),
+		size: size,
+	})
+	c.size += size
+	for c.size > c.maxBytes {
+		c.size -= c.entries[0].size
+		c.entries[0] = cacheEntry{}
+		c.entries = c.entries[1:]
+		c.base++
+	}
+}
+
+// Get returns a copy of the record at offset so callers are free to modify it.
+func (c *recordCache) Get(offset uint64) (*api.Record, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if offset < c.base || offset >= c.base+uint64(len(c.entries)) {
+		return nil, false
+	}
+	return proto.Clone(c.entries[offset-c.base].rec).(*api.Record), true
+}
+
+// GetInto copies the record at offset into rec.
+func (c *recordCache) GetInto(offset uint64, rec *api.Record) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if offset < c.base || offset >= c.base+uint64(len(c.entries)) {
+		return false
+	}
+	proto.Reset(rec)
+	proto.Merge(rec, c.entries[offset-c.base].rec)
+	return true
+}
+
+// TruncateAfter drops every cached record after offset.
+func (c *recordCache) TruncateAfter(offset uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if offset < c.base {
+		c.reset()
+		return
+	}
+	n := offset + 1 - c.base
+	for uint64(len(c.entries)) > n {
+		last := len(c.entries) - 1
+		c.size -= c.entries[last].size
+		c.entries[last] = cacheEntry{}
+		c.entries = c.entries[:last]
+	}
+}
+
+func (c *recordCache) Reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+}
+
+func (c *recordCache) reset() {
+	c.entries = nil
+	c.size = 0
+}
@@ -0,0 +1,92 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestCheckpointRecovery(t *testing.T) {
+	for scenario, withCheckpoint := range map[string]bool{
+		"recover from checkpoint":    true,
+		"recover without checkpoint": false,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "checkpoint-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			l, err := NewLog(dir, c)
+			require.NoError(t, err)
+			append := &api.Record{Value: []byte("hello world")}
+			for i := 0; i < 3; i++ {
+				_, err = l.Append(append)
+				require.NoError(t, err)
+			}
+			l.mu.RLock()
+			require.NoError(t, l.checkpoint(false))
+			l.mu.RUnlock()
+			for i := 0; i < 2; i++ {
+				_, err = l.Append(append)
+				require.NoError(t, err)
+			}
+			require.NoError(t, l.activeSegment.store.Sync())
+			size := l.activeSegment.store.size
+
+			// Crash part way through writing a record
+			f, err := os.OpenFile(l.activeSegment.path(".store"), os.O_WRONLY|os.O_APPEND, 0644)
+			require.NoError(t, err)
+			torn := make([]byte, lenWidth+3)
+			enc.PutUint64(torn, 100)
+			_, err = f.Write(torn)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			if !withCheckpoint {
+				require.NoError(t, os.Remove(path.Join(dir, checkpointFile)))
+			}
+
+			// Only the records after the checkpoint are replayed
+			cp, err := readCheckpoint(dir)
+			require.NoError(t, err)
+			if withCheckpoint {
+				require.Equal(t, uint64(3), l.replayFrom(cp))
+			} else {
+				require.Equal(t, uint64(0), l.replayFrom(cp))
+			}
+
+			l, err = NewLog(dir, c)
+			require.NoError(t, err)
+			offset, err := l.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), offset)
+			require.Equal(t, size, l.activeSegment.store.size)
+			for i := uint64(0); i <= offset; i++ {
+				read, err := l.Read(i)
+				require.NoError(t, err)
+				require.Equal(t, i, read.Offset)
+			}
+			offset, err = l.Append(append)
+			require.NoError(t, err)
+			require.Equal(t, uint64(5), offset)
+
+			cp, err = readCheckpoint(dir)
+			require.NoError(t, err)
+			require.False(t, cp.Clean)
+			size = l.activeSegment.store.size
+			require.NoError(t, l.Close())
+			cp, err = readCheckpoint(dir)
+			require.NoError(t, err)
+			require.True(t, cp.Clean)
+			require.Equal(t, 1, len(cp.Segments))
+			require.Equal(t, uint64(0), cp.Segments[0].BaseOffset)
+			require.Equal(t, uint64(6), cp.Segments[0].NextOffset)
+			require.Equal(t, size, cp.Segments[0].StoreSize)
+		})
+	}
+}
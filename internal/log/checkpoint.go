@@ -0,0 +1,118 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"time"
+)
+
+const checkpointFile = "checkpoint"
+
+// checkpoint records how far each segment was known to be durable and
+// consistent, so that after an unclean shutdown setup only has to validate
+// what was written since.
+type checkpoint struct {
+	// Clean is set when the log was closed cleanly, in which case the
+	// segment files can be trusted as is.
+	Clean    bool                `json:"clean"`
+	Segments []segmentCheckpoint `json:"segments"`
+	// Producers and Txns are the state the log derives from its records
+	// as of StateOffset, the offset after the last record they cover,
+	// along with the streams saved in the streams file. The records after
+	// it are replayed when the log is opened.
+	Producers   *producers `json:"producers,omitempty"`
+	Txns        *txns      `json:"txns,omitempty"`
+	StateOffset uint64     `json:"state_offset"`
+}
+
+type segmentCheckpoint struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	// StoreSize is the last verified position in the store: every record
+	// before it was synced to disk along with its index entry.
+	StoreSize uint64    `json:"store_size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// segment returns the checkpoint for the segment starting at baseOffset. A nil
+// checkpoint has none.
+func (c *checkpoint) segment(baseOffset uint64) (segmentCheckpoint, bool) {
+	if c == nil {
+		return segmentCheckpoint{}, false
+	}
+	for _, s := range c.Segments {
+		if s.BaseOffset == baseOffset {
+			return s, true
+		}
+	}
+	return segmentCheckpoint{}, false
+}
+
+// clean reports whether the checkpoint was written by a clean close. A nil
+// checkpoint isn't.
+func (c *checkpoint) clean() bool {
+	return c != nil && c.Clean
+}
+
+// readCheckpoint returns nil if dir has no checkpoint.
+func readCheckpoint(dir string) (*checkpoint, error) {
+	b, err := os.ReadFile(path.Join(dir, checkpointFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &checkpoint{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// writeCheckpoint atomically replaces dir's checkpoint by writing it to a
+// temporary file and renaming it over the old one.
+func writeCheckpoint(dir string, c *checkpoint) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	name := path.Join(dir, checkpointFile)
+	if err = writeFileSync(name+".tmp", b); err != nil {
+		return err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeFileSync writes b to the named file and syncs it to disk.
+func writeFileSync(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs dir so that files created, renamed or removed in it survive a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
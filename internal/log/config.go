@@ -1,9 +1,79 @@
 package log
 
+import "time"
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxOpenSegments bounds how many sealed segments are kept open at
+		// once. Sealed segments are opened on first read and the least
+		// recently read are closed past the budget. Zero means no limit.
+		MaxOpenSegments int
+		// MaxAge seals the active segment once it's been open this long,
+		// even if it isn't full, so that low-volume logs still roll. Zero
+		// disables time-based rolling.
+		MaxAge time.Duration
+		// MmapSealed reads sealed segments' stores through a memory
+		// mapping rather than the buffered file, so concurrent reads of
+		// older records don't serialise on the store's lock.
+		MmapSealed bool
+	}
+	Checkpoint struct {
+		// Interval is how often the log syncs its active segment and
+		// records a recovery checkpoint, besides when it rolls to a new
+		// segment or is closed. Zero disables periodic checkpoints. On
+		// open only the records after the checkpoint are replayed, and
+		// without one every record is.
+		Interval time.Duration
+	}
+	Merge struct {
+		// Interval is how often runs of adjacent small sealed segments are
+		// merged into one. Zero disables merging.
+		Interval time.Duration
+		// SmallSegmentBytes is the store size under which a sealed segment
+		// is merged with its neighbours. Defaults to half MaxStoreBytes.
+		SmallSegmentBytes uint64
+	}
+	Scrub struct {
+		// Interval is how often the next sealed segment is re-read and
+		// verified, so that corruption is found before a consumer hits
+		// it. Zero disables scrubbing.
+		Interval time.Duration
+	}
+	Storage struct {
+		// Dirs are extra directories, e.g. on other disks, that new
+		// segments are spread across along with the log's own directory.
+		// Like it, each must only be used by this log.
+		Dirs []string
+		// Placement picks the directory for each new segment.
+		Placement Placement
 	}
+	Quota struct {
+		// MaxBytes bounds the total size of the log's store files. Appends
+		// past it fail with api.ErrQuotaExceeded until retention frees
+		// space. Zero means no limit.
+		MaxBytes uint64
+		// MinFreeBytes is the free space appends leave on the active
+		// segment's disk. Zero means no floor. It's only enforced on
+		// Linux, where free space is measured.
+		MinFreeBytes uint64
+	}
+	ReadAhead struct {
+		// Bytes is how far ahead of a sequential reader the store is
+		// prefetched when reading sealed segments. Zero disables
+		// read-ahead.
+		Bytes uint64
+	}
+	Cache struct {
+		// MaxBytes bounds the encoded size of the recently appended records
+		// kept in memory for tailing consumers. Zero disables the cache.
+		MaxBytes uint64
+	}
+}
+
+// IndexBytes returns the MaxIndexBytes that fits records index entries.
+func IndexBytes(records uint64) uint64 {
+	return records * entryWidth
 }
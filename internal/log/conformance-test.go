@@ -0,0 +1,52 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/alphaleph/yojimbo/pkg/log/logtest"
+)
+
+func TestLogConformance(t *testing.T) {
+	c := Config{}
+	// Small segments so the suite crosses segment boundaries
+	c.Segment.MaxStoreBytes = 64
+	logtest.Run(t, diskHarness(c))
+}
+
+func TestMmapLogConformance(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.MmapSealed = true
+	logtest.Run(t, diskHarness(c))
+}
+
+func TestMemoryLogConformance(t *testing.T) {
+	logtest.Run(t, logtest.Harness{
+		New: func(t *testing.T) logtest.CommitLog {
+			return NewMemoryLog(Config{})
+		},
+	})
+}
+
+func diskHarness(c Config) logtest.Harness {
+	return logtest.Harness{
+		New: func(t *testing.T) logtest.CommitLog {
+			dir, err := os.MkdirTemp("", "conformance-test")
+			require.NoError(t, err)
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			l, err := NewLog(dir, c)
+			require.NoError(t, err)
+			return l
+		},
+		Reopen: func(t *testing.T, cl logtest.CommitLog) logtest.CommitLog {
+			l := cl.(*Log)
+			require.NoError(t, l.Close())
+			l, err := NewLog(l.Dir, l.Config)
+			require.NoError(t, err)
+			return l
+		},
+	}
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestLogDirs(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, l *Log){
+		"round robin placement":   testRoundRobin,
+		"most free placement":     testMostFree,
+		"offline directory":       testOfflineDir,
+		"resource errors":         testResourceErrors,
+		"all directories failing": testAllDirsFailing,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "dirs-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 2
+			c.Storage.Dirs = []string{path.Join(dir, "b"), path.Join(dir, "c")}
+			if scenario == "most free placement" {
+				c.Storage.Placement = MostFree
+			}
+			l, err := NewLog(path.Join(dir, "a"), c)
+			require.NoError(t, err)
+			fn(t, l)
+		})
+	}
+}
+
+func testRoundRobin(t *testing.T, l *Log) {
+	appendRecords(t, l, 6)
+	require.Equal(t, 4, len(l.segments))
+	for i, s := range l.segments {
+		require.Equal(t, l.dirs[i%3].path, s.dir)
+	}
+	require.NoError(t, l.Close())
+
+	// Segments are recovered from every directory
+	l, err := NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(l.segments))
+	for i, s := range l.segments {
+		require.Equal(t, l.dirs[i%3].path, s.dir)
+	}
+	requireRecords(t, l, 6)
+	require.NoError(t, l.Close())
+
+	// A segment showing up in two directories is refused
+	require.NoError(t, os.Link(
+		l.segments[1].path(".store"),
+		path.Join(l.Dir, path.Base(l.segments[1].path(".store"))),
+	))
+	_, err = NewLog(l.Dir, l.Config)
+	require.Error(t, err)
+}
+
+func testMostFree(t *testing.T, l *Log) {
+	// The directories share a disk, so any of them may be picked
+	appendRecords(t, l, 6)
+	require.Equal(t, 4, len(l.segments))
+	requireRecords(t, l, 6)
+}
+
+func testOfflineDir(t *testing.T, l *Log) {
+	appendRecords(t, l, 3)
+	// The active segment is in b, which fails
+	active := l.activeSegment
+	require.Equal(t, l.dirs[1].path, active.dir)
+	require.True(t, l.failDir(active.dir, &os.PathError{
+		Op: "write", Path: active.path(".store"), Err: syscall.EIO,
+	}))
+	require.False(t, l.failDir(active.dir, errors.New("not an I/O error")))
+
+	// Appends carry on in another directory
+	offset, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	require.NotEqual(t, active.dir, l.activeSegment.dir)
+	require.True(t, active.sealed)
+
+	// Records elsewhere are still served, those in b aren't
+	for i := uint64(0); i < 4; i++ {
+		_, err := l.Read(i)
+		if s := l.segment(i); s.dir == active.dir {
+			require.ErrorIs(t, err, ErrDirOffline)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+
+	// New segments aren't placed in b
+	appendRecords(t, l, 4)
+	for _, s := range l.segments[2:] {
+		require.NotEqual(t, active.dir, s.dir)
+	}
+}
+
+func testResourceErrors(t *testing.T, l *Log) {
+	appendRecords(t, l, 3)
+	active := l.activeSegment
+	require.Equal(t, l.dirs[1].path, active.dir)
+	// Running out of file descriptors or space doesn't mean the disk failed
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENOSPC} {
+		require.False(t, l.failDir(active.dir, &os.PathError{
+			Op: "open", Path: active.path(".store"), Err: errno,
+		}))
+		require.True(t, l.online(active.dir))
+	}
+	offset, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	require.Equal(t, active, l.segment(offset))
+	requireRecords(t, l, 4)
+}
+
+func testAllDirsFailing(t *testing.T, l *Log) {
+	for _, d := range l.dirs {
+		l.failDir(d.path, syscall.EIO)
+	}
+	// The log's own directory holds the checkpoint, so it stays online and
+	// takes the segments the others can't
+	require.True(t, l.online(l.Dir))
+	require.False(t, l.online(l.dirs[1].path))
+	require.False(t, l.online(l.dirs[2].path))
+	appendRecords(t, l, 4)
+	require.Equal(t, l.Dir, l.activeSegment.dir)
+}
+
+func appendRecords(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+}
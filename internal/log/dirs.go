@@ -0,0 +1,152 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// Placement picks the directory each new segment is created in.
+type Placement int
+
+const (
+	// RoundRobin cycles through the online directories.
+	RoundRobin Placement = iota
+	// MostFree picks the online directory with the most free space. Free space
+	// is only measured on Linux, elsewhere it picks the first.
+	MostFree
+)
+
+// ErrDirOffline is returned when reading a segment whose directory went
+// offline after a media error.
+var ErrDirOffline = errors.New("log directory is offline")
+
+// dataDir is a directory segments are placed in. It goes offline on its first
+// media error, after which no new segments are placed in it and its segments
+// aren't read until the log is reopened.
+type dataDir struct {
+	path    string
+	offline atomic.Bool
+}
+
+// setupDirs creates the log's directories. The log's own directory holds its
+// checkpoint so it must be usable, but the others are only marked offline if
+// their disk is failing.
+func (l *Log) setupDirs() error {
+	l.dirs = nil
+	for _, dir := range append([]string{l.Dir}, l.Config.Storage.Dirs...) {
+		d := &dataDir{path: dir}
+		l.dirs = append(l.dirs, d)
+		if err := os.MkdirAll(dir, 0755); err != nil && !l.failDir(dir, err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dir returns the data directory at path.
+func (l *Log) dir(path string) *dataDir {
+	for _, d := range l.dirs {
+		if d.path == path {
+			return d
+		}
+	}
+	return nil
+}
+
+// online reports whether the segments in path can be used.
+func (l *Log) online(path string) bool {
+	d := l.dir(path)
+	return d != nil && !d.offline.Load()
+}
+
+// failDir takes path offline if err is a media error and reports whether it
+// did. The log's own directory never goes offline since it holds the
+// checkpoint, so its errors are always left to the caller. It's safe to call
+// with l.mu held shared.
+func (l *Log) failDir(path string, err error) bool {
+	if path == l.Dir || !isMediaError(err) {
+		return false
+	}
+	d := l.dir(path)
+	if d == nil {
+		return false
+	}
+	if d.offline.CompareAndSwap(false, true) {
+		zap.L().Named("log").Error(
+			"log directory offline",
+			zap.String("dir", path),
+			zap.Error(err),
+		)
+	}
+	return true
+}
+
+func isMediaError(err error) bool {
+	for _, target := range mediaErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// place returns the directory for a new segment. The caller must hold l.mu.
+func (l *Log) place() (string, error) {
+	var online []*dataDir
+	for _, d := range l.dirs {
+		if !d.offline.Load() {
+			online = append(online, d)
+		}
+	}
+	if len(online) == 0 {
+		return "", fmt.Errorf("%w: no log directory left to place segments in", ErrDirOffline)
+	}
+	switch l.Config.Storage.Placement {
+	case MostFree:
+		var best string
+		var most uint64
+		for _, d := range online {
+			free, err := freeBytes(d.path)
+			if l.failDir(d.path, err) {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			if best == "" || free > most {
+				best, most = d.path, free
+			}
+		}
+		if best == "" {
+			return l.place()
+		}
+		return best, nil
+	default:
+		d := online[l.nextDir%len(online)]
+		l.nextDir++
+		return d.path, nil
+	}
+}
+
+// moveActive abandons the active segment once its directory is offline and
+// carries on appending in a new segment placed elsewhere. Records that weren't
+// synced before the directory failed are lost. The caller must hold l.mu.
+func (l *Log) moveActive() error {
+	s := l.activeSegment
+	if err := s.Abandon(); err != nil {
+		zap.L().Named("log").Warn(
+			"failed to close abandoned segment",
+			zap.String("dir", s.dir),
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Error(err),
+		)
+	}
+	if err := l.newSegment(s.nextOffset); err != nil {
+		return err
+	}
+	return l.checkpoint(false)
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package log
+
+import "syscall"
+
+// mediaErrors are the errors that mean a directory's disk is failing. Others,
+// like running out of file descriptors or space, are returned to the caller
+// and leave the directory online since they may well go away.
+var mediaErrors = []error{
+	syscall.EIO,
+	syscall.EROFS,
+	syscall.ENXIO,
+	syscall.ENODEV,
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package log
+
+// mediaErrors is empty where failing disks' errors aren't known, so every
+// error is returned to the caller and directories stay online.
+var mediaErrors []error
@@ -0,0 +1,26 @@
+//go:build linux
+
+package log
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fadvise asks the kernel to start reading length bytes of f from offset into
+// the page cache in the background.
+func fadvise(f *os.File, offset, length int64) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	err = rc.Control(func(fd uintptr) {
+		ferr = unix.Fadvise(int(fd), offset, length, unix.FADV_WILLNEED)
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
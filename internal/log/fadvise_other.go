@@ -0,0 +1,11 @@
+//go:build !linux
+
+package log
+
+import "os"
+
+// fadvise is a no-op where posix_fadvise isn't available, leaving read-ahead
+// to the OS's own heuristics.
+func fadvise(f *os.File, offset, length int64) error {
+	return nil
+}
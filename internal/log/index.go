@@ -85,6 +85,38 @@ func (i *index) Write(offset uint32, pos uint64) error {
 	return nil
 }
 
+// Truncate drops every entry past the first n, zeroing them so they can't be
+// mistaken for live entries if we crash before the index is closed.
+func (i *index) Truncate(n uint64) error {
+	size := n * entryWidth
+	if size >= i.size {
+		return nil
+	}
+	clear(i.mmap[size:i.size])
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	i.size = size
+	return nil
+}
+
+// Reset sets the index to its first n entries, clearing everything past them.
+// It's used when recovering from an unclean shutdown, where the file's size
+// can't be trusted since it's only truncated to fit the entries on Close.
+func (i *index) Reset(n uint64) error {
+	size := n * entryWidth
+	if size > uint64(len(i.mmap)) {
+		return io.EOF
+	}
+	clear(i.mmap[size:])
+	i.size = size
+	return nil
+}
+
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
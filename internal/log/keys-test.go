@@ -0,0 +1,62 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyIndex(t *testing.T) {
+	f, err := os.CreateTemp("", "keys-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, f.Close())
+	// Segments open their key index for appending
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+
+	k, err := newKeyIndex(f)
+	require.NoError(t, err)
+	entries := []keyEntry{
+		{Key: "a", Version: 0, Offset: 10},
+		{Key: "bb", Version: 0, Offset: 12},
+		{Key: "a", Version: 1, Offset: 13, Prev: 10},
+	}
+	for _, e := range entries {
+		require.NoError(t, k.Write(e))
+	}
+	require.Equal(t, []keyEntry{entries[0], entries[2]}, k.Lookup("a"))
+	last, ok := k.Last("a")
+	require.True(t, ok)
+	require.Equal(t, entries[2], last)
+	_, ok = k.Last("c")
+	require.False(t, ok)
+	require.Equal(t, entries[1:], k.From(11))
+
+	dropped, err := k.TruncateFrom(13)
+	require.NoError(t, err)
+	require.Equal(t, entries[2:], dropped)
+	require.Equal(t, entries[:1], k.Lookup("a"))
+	require.NoError(t, k.Write(keyEntry{Key: "c", Version: 0, Offset: 13}))
+	require.Equal(t, append(entries[:2:2], keyEntry{Key: "c", Version: 0, Offset: 13}), k.From(0))
+	require.NoError(t, k.Close())
+
+	// Entries survive reopening the file, and a torn entry at its end is
+	// dropped
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 'd'})
+	require.NoError(t, err)
+	k, err = newKeyIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, entries[1:2], k.Lookup("bb"))
+	require.NoError(t, k.Write(keyEntry{Key: "a", Version: 1, Offset: 14, Prev: 10}))
+	require.NoError(t, k.Close())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	k, err = newKeyIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, []keyEntry{entries[0], {Key: "a", Version: 1, Offset: 14, Prev: 10}}, k.Lookup("a"))
+	require.NoError(t, k.Close())
+}
@@ -0,0 +1,199 @@
+package log
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	keyLenWidth = 4
+	// keyEntryWidth is the width of an entry besides its key.
+	keyEntryWidth = keyLenWidth + 8 + 8 + 8
+)
+
+// keyIndex is a segment's index of its keyed records, kept in a .keys file
+// beside its store and index. The file is read once when the segment opens and
+// its entries are kept in memory with each key's positions, so lookups don't
+// touch the file while the segment stays open.
+type keyIndex struct {
+	mu   sync.RWMutex
+	file *os.File
+	buf  *bufio.Writer
+	size uint64
+
+	entries []keyEntry
+	// ends holds where each entry ends in the file.
+	ends []uint64
+	// byKey holds the positions in entries of each key's entries.
+	byKey map[string][]int
+}
+
+// keyEntry indexes a keyed record. Prev is the offset of the key's record
+// before it, so a stream is walked back without searching for each version.
+// It's only set when Version is above zero, and is noPrev if the record
+// before couldn't be found.
+type keyEntry struct {
+	Key     string
+	Version uint64
+	Offset  uint64
+	Prev    uint64
+}
+
+// noPrev is the Prev of an entry whose previous record couldn't be found, e.g.
+// because it was truncated.
+const noPrev = ^uint64(0)
+
+// newKeyIndex loads f's entries, dropping any torn entry a crash left at its
+// end.
+func newKeyIndex(f *os.File) (*keyIndex, error) {
+	k := &keyIndex{
+		file:  f,
+		buf:   bufio.NewWriter(f),
+		byKey: make(map[string][]int),
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, fi.Size())
+	if _, err = f.ReadAt(p, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for pos := uint64(0); pos+keyEntryWidth <= uint64(len(p)); {
+		n := uint64(enc.Uint32(p[pos:]))
+		if pos+keyEntryWidth+n > uint64(len(p)) {
+			break
+		}
+		key := pos + keyLenWidth
+		pos += keyEntryWidth + n
+		k.add(keyEntry{
+			Key:     string(p[key : key+n]),
+			Version: enc.Uint64(p[key+n:]),
+			Offset:  enc.Uint64(p[key+n+8:]),
+			Prev:    enc.Uint64(p[key+n+16:]),
+		}, pos)
+	}
+	if k.size < uint64(len(p)) {
+		if err = f.Truncate(int64(k.size)); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// add notes e, which ends at end in the file. The caller must hold k.mu.
+func (k *keyIndex) add(e keyEntry, end uint64) {
+	k.byKey[e.Key] = append(k.byKey[e.Key], len(k.entries))
+	k.entries = append(k.entries, e)
+	k.ends = append(k.ends, end)
+	k.size = end
+}
+
+// Write appends e, which must be for a later offset than the entries before it.
+func (k *keyIndex) Write(e keyEntry) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	p := make([]byte, keyEntryWidth+len(e.Key))
+	enc.PutUint32(p, uint32(len(e.Key)))
+	copy(p[keyLenWidth:], e.Key)
+	enc.PutUint64(p[keyLenWidth+len(e.Key):], e.Version)
+	enc.PutUint64(p[keyLenWidth+len(e.Key)+8:], e.Offset)
+	enc.PutUint64(p[keyLenWidth+len(e.Key)+16:], e.Prev)
+	if _, err := k.buf.Write(p); err != nil {
+		return err
+	}
+	k.add(e, k.size+uint64(len(p)))
+	return nil
+}
+
+// Lookup returns key's entries in offset order.
+func (k *keyIndex) Lookup(key string) []keyEntry {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	positions := k.byKey[key]
+	found := make([]keyEntry, 0, len(positions))
+	for _, i := range positions {
+		found = append(found, k.entries[i])
+	}
+	return found
+}
+
+// Last returns key's last entry.
+func (k *keyIndex) Last(key string) (keyEntry, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	positions := k.byKey[key]
+	if len(positions) == 0 {
+		return keyEntry{}, false
+	}
+	return k.entries[positions[len(positions)-1]], true
+}
+
+// From returns the entries for the records from offset on.
+func (k *keyIndex) From(offset uint64) []keyEntry {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]keyEntry(nil), k.entries[k.cut(offset):]...)
+}
+
+// TruncateFrom drops the entries for the records from offset on and returns
+// them.
+func (k *keyIndex) TruncateFrom(offset uint64) ([]keyEntry, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	i := k.cut(offset)
+	if i == len(k.entries) {
+		return nil, nil
+	}
+	if err := k.buf.Flush(); err != nil {
+		return nil, err
+	}
+	// The file ends after the last entry that's kept
+	var size uint64
+	if i > 0 {
+		size = k.ends[i-1]
+	}
+	if err := k.file.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+	dropped := append([]keyEntry(nil), k.entries[i:]...)
+	for j := len(k.entries) - 1; j >= i; j-- {
+		key := k.entries[j].Key
+		k.byKey[key] = k.byKey[key][:len(k.byKey[key])-1]
+		if len(k.byKey[key]) == 0 {
+			delete(k.byKey, key)
+		}
+	}
+	k.entries, k.ends, k.size = k.entries[:i], k.ends[:i], size
+	return dropped, nil
+}
+
+// cut returns the index of the first entry at or after offset. The caller
+// must hold k.mu.
+func (k *keyIndex) cut(offset uint64) int {
+	return sort.Search(len(k.entries), func(i int) bool {
+		return k.entries[i].Offset >= offset
+	})
+}
+
+// Sync flushes buffered entries and commits the file to disk.
+func (k *keyIndex) Sync() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.buf.Flush(); err != nil {
+		return err
+	}
+	return k.file.Sync()
+}
+
+func (k *keyIndex) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.buf.Flush(); err != nil {
+		return err
+	}
+	return k.file.Close()
+}
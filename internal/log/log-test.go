@@ -1,11 +1,16 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 
 	api "github.com/alphaleph/yojimbo/api/v1"
@@ -14,10 +19,13 @@ import (
 func TestLog(t *testing.T) {
 	for scenario, fn := range map[string]func(t *testing.T, l *Log){
 		"append and read a record":    testAppendRead,
+		"read into a record":          testReadInto,
 		"offset out of range error":   testOutOfRangeErr,
 		"init with existing segments": testInitExisting,
 		"reader":                      testReader,
 		"truncate":                    testTruncate,
+		"truncate past highest":       testTruncatePastHighest,
+		"truncate after":              testTruncateAfter,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "log-test")
@@ -45,6 +53,24 @@ func testAppendRead(t *testing.T, l *Log) {
 	require.Equal(t, append.Value, read.Value)
 }
 
+func testReadInto(t *testing.T, l *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("hello world %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	read := &api.Record{}
+	for i := uint64(0); i < 3; i++ {
+		err := l.ReadInto(i, read)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), read.Value)
+	}
+	err := l.ReadInto(3, read)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+}
+
 func testOutOfRangeErr(t *testing.T, l *Log) {
 	read, err := l.Read(1)
 	require.Nil(t, read)
@@ -109,3 +135,369 @@ func testTruncate(t *testing.T, l *Log) {
 	_, err = l.Read(0)
 	require.NoError(t, err)
 }
+
+func testTruncatePastHighest(t *testing.T, l *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(append)
+		require.NoError(t, err)
+	}
+	for _, cutoff := range []uint64{4, 100} {
+		require.NoError(t, l.Truncate(cutoff))
+		_, err := l.Read(4)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+		lowest, err := l.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), lowest)
+	}
+
+	// The log carries on from where it was truncated, also after a restart
+	offset, err := l.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), offset)
+	require.NoError(t, l.Close())
+	l, err = NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer l.Close()
+	read, err := l.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+}
+
+func testTruncateAfter(t *testing.T, l *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(append)
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(l.segments), 2)
+
+	// Offset 2 opens the second segment, so the cut crosses a segment boundary
+	err := l.TruncateAfter(2)
+	require.NoError(t, err)
+	offset, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+	_, err = l.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+	offset, err = l.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	offset, err = l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	for i := uint64(0); i <= offset; i++ {
+		read, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+
+	err = l.TruncateAfter(0)
+	require.NoError(t, err)
+	offset, err = l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+}
+
+func BenchmarkRead(b *testing.B) {
+	l := benchmarkLog(b)
+	defer l.Remove()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.Read(uint64(i % 1024)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadInto(b *testing.B) {
+	l := benchmarkLog(b)
+	defer l.Remove()
+	read := &api.Record{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := l.ReadInto(uint64(i%1024), read); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Sealed segments are read through the store's lock unless they're mapped, so
+// the parallel benchmarks read sealed segments only.
+func BenchmarkReadParallel(b *testing.B) {
+	benchmarkReadParallel(b, false)
+}
+
+func BenchmarkReadParallelMmap(b *testing.B) {
+	benchmarkReadParallel(b, true)
+}
+
+func benchmarkReadParallel(b *testing.B, mmap bool) {
+	l := benchmarkLog(b, func(c *Config) {
+		c.Segment.MaxStoreBytes = 64 << 10
+		c.Segment.MmapSealed = mmap
+	})
+	defer l.Remove()
+	sealed := l.activeSegment.baseOffset
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		read := &api.Record{}
+		var i uint64
+		for pb.Next() {
+			if err := l.ReadInto(i%sealed, read); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func benchmarkLog(b *testing.B, opts ...func(*Config)) *Log {
+	b.Helper()
+	dir, err := os.MkdirTemp("", "log-bench")
+	require.NoError(b, err)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	for _, opt := range opts {
+		opt(&c)
+	}
+	l, err := NewLog(dir, c)
+	require.NoError(b, err)
+	append := &api.Record{Value: make([]byte, 256)}
+	for i := 0; i < 1024; i++ {
+		_, err := l.Append(append)
+		require.NoError(b, err)
+	}
+	return l
+}
+
+func TestLogOpenSegmentBudget(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-open-segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.MaxOpenSegments = 1
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 8; i++ {
+		_, err := l.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// Only the active segment is opened on startup
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(l.segments))
+	for _, s := range l.segments[:len(l.segments)-1] {
+		require.Nil(t, s.store)
+	}
+	require.NotNil(t, l.activeSegment.store)
+	offset, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), offset)
+
+	// Reading sealed segments keeps at most one of them open
+	for i := uint64(0); i <= offset; i++ {
+		read, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		open := 0
+		for _, s := range l.segments[:len(l.segments)-1] {
+			if s.store != nil {
+				open++
+			}
+		}
+		require.LessOrEqual(t, open, 1)
+	}
+
+	b, err := io.ReadAll(l.Reader())
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+	require.NoError(t, l.Close())
+}
+
+func TestLogOpenSegmentBudgetConcurrentReads(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-open-segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.MaxOpenSegments = 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 16; i++ {
+		_, err := l.Append(append)
+		require.NoError(t, err)
+	}
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+
+	// More readers than the budget, each going through the segments in a
+	// different order so they keep evicting each other's
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for r := uint64(0); r < 8; r++ {
+		wg.Add(1)
+		go func(r uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < 200; i++ {
+				offset := (i*(2*r+1) + r) % (highest + 1)
+				read, err := l.Read(offset)
+				if err == nil && read.Offset != offset {
+					err = fmt.Errorf("read %d at offset %d", read.Offset, offset)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// The next read closes whatever the readers kept open over budget, and
+	// no sealed segment was left open without being tracked
+	_, err = l.Read(0)
+	require.NoError(t, err)
+	require.LessOrEqual(t, l.open.Len(), 2)
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if s.store != nil {
+			require.Contains(t, l.open.elements, s)
+		}
+	}
+}
+
+func TestLogMaxAge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-max-age-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxAge = 50 * time.Millisecond
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	append := &api.Record{Value: []byte("hello world")}
+
+	_, err = l.Append(append)
+	require.NoError(t, err)
+	segments := func() int {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		return len(l.segments)
+	}
+
+	// The background ticker rolls the segment once it's expired
+	require.Eventually(t, func() bool {
+		return segments() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// but never rolls an empty active segment
+	time.Sleep(2 * c.Segment.MaxAge)
+	require.Equal(t, 2, segments())
+	createdAt := l.activeSegment.createdAt
+	require.NoError(t, l.Close())
+
+	// Creation times survive a restart
+	c.Segment.MaxAge = time.Hour
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.True(t, createdAt.Equal(l.activeSegment.createdAt))
+
+	// Appending to an expired segment rolls it first
+	_, err = l.Append(append)
+	require.NoError(t, err)
+	l.activeSegment.createdAt = time.Now().Add(-2 * time.Hour)
+	offset, err := l.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(l.segments))
+	require.Equal(t, offset, l.activeSegment.baseOffset)
+	require.NoError(t, l.Close())
+}
+
+func TestLogQuota(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-quota-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	append := &api.Record{Value: []byte("hello world")}
+	width := uint64(proto.Size(&api.Record{
+		Value:     append.Value,
+		Offset:    1,
+		Timestamp: time.Now().UnixMilli(),
+	})) + lenWidth
+	c := Config{}
+	c.Segment.MaxStoreBytes = 2 * width
+	c.Quota.MaxBytes = 4 * width
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { l.Close() }()
+
+	for i := 0; i < 4; i++ {
+		_, err = l.Append(append)
+		require.NoError(t, err)
+	}
+	_, err = l.Append(append)
+	apiErr, ok := err.(api.ErrQuotaExceeded)
+	require.True(t, ok)
+	require.Equal(t, width, apiErr.Requested)
+	require.Less(t, apiErr.Available, width)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	// The rejected append didn't write anything
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), highest)
+
+	// Appends resume once retention frees space
+	requireBytes(t, l)
+	require.NoError(t, l.Truncate(2))
+	requireBytes(t, l)
+	offset, err := l.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), offset)
+	requireBytes(t, l)
+	require.NoError(t, l.TruncateAfter(3))
+	requireBytes(t, l)
+	require.NoError(t, l.Close())
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	requireBytes(t, l)
+
+	// An unreachable free space floor refuses every append
+	l.Config.Quota.MinFreeBytes = 1 << 62
+	_, err = l.Append(append)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+// requireBytes checks the log's running byte total against its segments.
+func requireBytes(t *testing.T, l *Log) {
+	t.Helper()
+	var size uint64
+	for _, s := range l.segments {
+		size += s.Size()
+	}
+	require.Equal(t, size, l.bytes)
+}
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -8,6 +10,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 
 	api "github.com/alphaleph/yojimbo/api/v1"
 )
@@ -18,6 +26,31 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	dirs          []*dataDir
+	nextDir       int
+	open          *segmentLRU
+	cache         *recordCache
+	readAhead     *readAhead
+	ctx           context.Context
+	done          chan struct{}
+	wg            sync.WaitGroup
+
+	// corrupt holds the corrupt ranges the scrubber found in each segment
+	// and scrubNext is the offset it resumes from.
+	corrupt   map[*segment][]*api.OffsetRange
+	scrubNext uint64
+
+	// tailTruncations counts calls to TruncateAfter, which can rewrite the
+	// records of segments a merge is copying.
+	tailTruncations uint64
+
+	// bytes is the total size of the segments' stores, kept up to date so
+	// the quota is checked without summing them on every append.
+	bytes uint64
+
+	producers *producers
+	streams   *streams
+	txns      *txns
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -27,106 +60,609 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	ctx, err := tag.New(context.Background(), tag.Upsert(keyDir, dir))
+	if err != nil {
+		return nil, err
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:       dir,
+		Config:    c,
+		cache:     newRecordCache(c.Cache.MaxBytes),
+		readAhead: newReadAhead(c.ReadAhead.Bytes),
+		ctx:       ctx,
 	}
 	return l, l.setup()
 }
 
+// setup only opens the active segment. Sealed segments end where the next one
+// begins, so their offsets are known from the file names alone and they're
+// opened on first read. Unless the log was closed cleanly, the active segment
+// is validated from the last checkpoint onwards.
 func (l *Log) setup() error {
-	files, err := os.ReadDir(l.Dir)
+	l.open = newSegmentLRU(l.Config.Segment.MaxOpenSegments)
+	if err := l.setupDirs(); err != nil {
+		return err
+	}
+	cp, err := readCheckpoint(l.Dir)
+	if err != nil {
+		return err
+	}
+	streams, found, err := openStreams(l.Dir)
+	if err != nil {
+		return err
+	}
+	if !found && cp != nil {
+		// The state in the checkpoint is incomplete without the streams,
+		// so it's rebuilt from the records instead
+		cp.Producers = nil
+	}
+	var lost []keyEntry
+	if err = l.finishMerge(); err != nil {
+		return err
+	}
+	baseOffsets, dirs, err := l.segmentBaseOffsets()
+	if err != nil {
+		return err
+	}
+	for i, baseOffset := range baseOffsets {
+		if i == len(baseOffsets)-1 {
+			if err = l.openSegment(dirs[i], baseOffset); err != nil {
+				return err
+			}
+			break
+		}
+		s := newSealedSegment(dirs[i], baseOffset, baseOffsets[i+1], 0, l.Config)
+		sc, ok := cp.segment(baseOffset)
+		if ok {
+			s.createdAt = sc.CreatedAt
+		}
+		// The checkpoint's size is stale if the segment was merged since
+		if ok && sc.NextOffset == s.nextOffset {
+			s.size = sc.StoreSize
+		} else if fi, err := os.Stat(s.path(".store")); err == nil {
+			s.size = uint64(fi.Size())
+			if !ok {
+				s.createdAt = fi.ModTime()
+			}
+		}
+		l.segments = append(l.segments, s)
+	}
+	if l.segments == nil {
+		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+			return err
+		}
+	} else {
+		sc, ok := cp.segment(l.activeSegment.baseOffset)
+		if ok {
+			l.activeSegment.createdAt = sc.CreatedAt
+		} else if fi, err := os.Stat(l.activeSegment.path(".store")); err == nil {
+			l.activeSegment.createdAt = fi.ModTime()
+		}
+		if !cp.clean() {
+			nextOffset, pos := l.activeSegment.baseOffset, uint64(0)
+			if ok {
+				nextOffset, pos = sc.NextOffset, sc.StoreSize
+			}
+			lost, err = l.activeSegment.Recover(nextOffset, pos, l.findPrev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	l.bytes = 0
+	for _, s := range l.segments {
+		l.bytes += s.Size()
+	}
+	if err = l.recoverState(cp, streams, lost); err != nil {
+		return err
+	}
+	// Until the log is closed again its files can't be trusted as is
+	if err = l.checkpoint(false); err != nil {
+		return err
+	}
+	l.start()
+	return nil
+}
+
+// newSegment starts the active segment at offset in the directory picked by
+// the placement policy, trying another if the directory fails.
+func (l *Log) newSegment(offset uint64) error {
+	for {
+		dir, err := l.place()
+		if err != nil {
+			return err
+		}
+		err = l.openSegment(dir, offset)
+		if !l.failDir(dir, err) {
+			return err
+		}
+	}
+}
+
+func (l *Log) openSegment(dir string, offset uint64) error {
+	s, err := newSegment(dir, offset, l.Config)
 	if err != nil {
 		return err
 	}
+	l.segments = append(l.segments, s)
+	l.activeSegment = s
+	return nil
+}
+
+// segmentBaseOffsets returns the sorted base offsets of the segments in all
+// of the log's online directories along with the directory each is in.
+func (l *Log) segmentBaseOffsets() ([]uint64, []string, error) {
+	found := make(map[uint64]string)
+	for _, d := range l.dirs {
+		if d.offline.Load() {
+			continue
+		}
+		baseOffsets, err := segmentBaseOffsets(d.path)
+		if l.failDir(d.path, err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, offset := range baseOffsets {
+			if dir, ok := found[offset]; ok {
+				return nil, nil, fmt.Errorf(
+					"segment %d is in both %s and %s", offset, dir, d.path,
+				)
+			}
+			found[offset] = d.path
+		}
+	}
+	baseOffsets := make([]uint64, 0, len(found))
+	for offset := range found {
+		baseOffsets = append(baseOffsets, offset)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	dirs := make([]string, len(baseOffsets))
+	for i, offset := range baseOffsets {
+		dirs[i] = found[offset]
+	}
+	return baseOffsets, dirs, nil
+}
+
+// segmentBaseOffsets returns the sorted base offsets of the segments in dir.
+func segmentBaseOffsets(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
 	var baseOffsets []uint64
 	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		offset, err := strconv.ParseUint(
+			strings.TrimSuffix(file.Name(), ".store"), 10, 0,
 		)
-		offset, _ := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, offset)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
+	return baseOffsets, nil
+}
+
+// roll seals the active segment and starts a new one at offset.
+func (l *Log) roll(offset uint64) error {
+	if err := l.activeSegment.Seal(); err != nil {
+		if l.failDir(l.activeSegment.dir, err) {
+			return l.moveActive()
 		}
-		// baseOffset contains dupes for index and store so we skip the dupes
-		i++
+		return err
 	}
-	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+	if err := l.closeEvicted(l.open.Touch(l.activeSegment)); err != nil {
+		return err
+	}
+	if err := l.newSegment(offset); err != nil {
+		return err
+	}
+	return l.checkpoint(false)
+}
+
+// checkpoint syncs the active segment, saves the streams that changed and
+// records how far each segment is known to be consistent. The caller must hold
+// l.mu.
+func (l *Log) checkpoint(clean bool) error {
+	if err := l.activeSegment.Sync(); err != nil {
+		return err
+	}
+	if err := l.streams.Save(); err != nil {
+		return err
+	}
+	return writeCheckpoint(l.Dir, l.newCheckpoint(clean))
+}
+
+func (l *Log) newCheckpoint(clean bool) *checkpoint {
+	cp := &checkpoint{
+		Clean:       clean,
+		Producers:   l.producers.Clone(),
+		Txns:        l.txns.Clone(),
+		StateOffset: l.activeSegment.nextOffset,
+	}
+	for _, s := range l.segments {
+		cp.Segments = append(cp.Segments, segmentCheckpoint{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreSize:  s.Size(),
+			CreatedAt:  s.createdAt,
+		})
+	}
+	return cp
+}
+
+// recoverState restores the state derived from the log's records from cp and
+// replays only the records appended since it was taken, from cp.StateOffset
+// on. Without a checkpoint, e.g. because it was deleted, the state has to be
+// rebuilt from every record in the log, which reads all of its segments once
+// before the log opens. setup writes a checkpoint straight after, so that's
+// only paid on the first open. streams were loaded from the streams file and
+// are as of cp.StateOffset too. lost are the key index entries of the records
+// recovering the active segment dropped.
+func (l *Log) recoverState(cp *checkpoint, streams *streams, lost []keyEntry) error {
+	l.producers, l.streams, l.txns = newProducers(), streams, newTxns()
+	if cp != nil && cp.Producers != nil {
+		l.producers = cp.Producers
+		if cp.Txns != nil {
+			l.txns = cp.Txns
+		}
+	} else {
+		l.streams.Reset()
+	}
+	// The snapshot may predate a truncation of the oldest records
+	l.txns.Truncate(l.segments[0].baseOffset)
+	from, next := l.replayFrom(cp), l.activeSegment.nextOffset
+	if from > next {
+		// Records the snapshot saw were lost with the unsynced tail
+		if next > 0 {
+			l.producers.TruncateAfter(next - 1)
+			l.txns.TruncateAfter(next - 1)
+		}
+		l.streams.Removed(lost)
+		return nil
+	}
+	if cp == nil || cp.Producers == nil {
+		zap.L().Named("log").Warn(
+			"no checkpoint, replaying every record",
+			zap.String("dir", l.Dir),
+			zap.Uint64("records", next-from),
+		)
+	}
+	rec := &api.Record{}
+	for offset := from; offset < next; offset++ {
+		if err := l.ReadInto(offset, rec); err != nil {
 			return err
 		}
+		l.producers.Appended(rec)
+		l.streams.Appended(rec)
+		l.txns.Appended(rec)
 	}
 	return nil
 }
 
-func (l *Log) newSegment(offset uint64) error {
-	s, err := newSegment(l.Dir, offset, l.Config)
+// replayFrom returns the offset recoverState replays records from: where cp's
+// state ends, or the oldest record if cp has no state.
+func (l *Log) replayFrom(cp *checkpoint) uint64 {
+	from := l.segments[0].baseOffset
+	if cp != nil && cp.Producers != nil && cp.StateOffset > from {
+		from = cp.StateOffset
+	}
+	return from
+}
+
+// start runs the log's background tasks until it's closed.
+func (l *Log) start() {
+	l.done = make(chan struct{})
+	l.every(l.Config.Checkpoint.Interval, func() error {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		return l.checkpoint(false)
+	})
+	l.every(l.Config.Merge.Interval, l.merge)
+	l.every(l.Config.Scrub.Interval, l.scrub)
+	l.every(l.Config.Segment.MaxAge/10, func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.rollIfExpired()
+	})
+}
+
+// rollIfExpired seals the active segment once it's older than the configured
+// max age. It's checked on append and periodically, so that a log that's
+// rarely written to still rolls and its old records can be truncated. The
+// caller must hold l.mu.
+func (l *Log) rollIfExpired() error {
+	if !l.activeSegment.IsExpired(time.Now()) {
+		return nil
+	}
+	return l.roll(l.activeSegment.nextOffset)
+}
+
+// every calls fn every interval in the background until the log is closed. A
+// zero interval disables it.
+func (l *Log) every(interval time.Duration, fn func() error) {
+	if interval == 0 {
+		return
+	}
+	done := l.done
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := fn(); err != nil {
+					zap.L().Named("log").Error(
+						"background task failed",
+						zap.String("dir", l.Dir),
+						zap.Error(err),
+					)
+				}
+			}
+		}
+	}()
+}
+
+// stop stops the background tasks and waits for them to return.
+func (l *Log) stop() {
+	if l.done == nil {
+		return
+	}
+	close(l.done)
+	l.wg.Wait()
+	l.done = nil
+}
+
+// acquire opens s if needed and keeps it open until l.release is called,
+// closing the least recently read sealed segments if that takes the log over
+// its open segment budget. The caller must hold l.mu.
+func (l *Log) acquire(s *segment) error {
+	if !l.online(s.dir) {
+		return fmt.Errorf("%w: %s", ErrDirOffline, s.dir)
+	}
+	if s != l.activeSegment {
+		if err := l.closeEvicted(l.open.Pin(s)); err != nil {
+			l.open.Unpin(s)
+			return err
+		}
+	}
+	err := s.acquire()
 	if err != nil {
-		return err
+		l.open.Unpin(s)
+	}
+	l.failDir(s.dir, err)
+	return err
+}
+
+// release lets s be closed again once it was acquired.
+func (l *Log) release(s *segment) {
+	s.release()
+	l.open.Unpin(s)
+}
+
+func (l *Log) closeEvicted(segments []*segment) error {
+	for _, s := range segments {
+		if err := s.Close(); err != nil {
+			return err
+		}
 	}
-	l.segments = append(l.segments, s)
-	l.activeSegment = s
 	return nil
 }
 
 func (l *Log) Read(offset uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= offset && offset < segment.nextOffset {
-			s = segment
-			break
+	s := l.segment(offset)
+	if s == nil {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	if l.cache != nil {
+		if rec, ok := l.cache.Get(offset); ok {
+			stats.Record(l.ctx, cacheHits.M(1))
+			return rec, nil
 		}
+		stats.Record(l.ctx, cacheMisses.M(1))
 	}
-	if s == nil || s.nextOffset <= offset {
-		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	if err := l.acquire(s); err != nil {
+		return nil, err
 	}
-	return s.Read(offset)
+	defer l.release(s)
+	l.prefetch(s, offset)
+	rec, err := s.Read(offset)
+	l.failDir(s.dir, err)
+	return rec, err
+}
+
+// ReadInto decodes the record at offset into rec rather than allocating a new
+// record, so consumers streaming many records can reuse one.
+func (l *Log) ReadInto(offset uint64, rec *api.Record) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.readInto(offset, rec)
+}
+
+// readInto decodes the record at offset into rec. The caller must hold l.mu.
+func (l *Log) readInto(offset uint64, rec *api.Record) error {
+	s := l.segment(offset)
+	if s == nil {
+		return api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	if l.cache != nil {
+		if l.cache.GetInto(offset, rec) {
+			stats.Record(l.ctx, cacheHits.M(1))
+			return nil
+		}
+		stats.Record(l.ctx, cacheMisses.M(1))
+	}
+	if err := l.acquire(s); err != nil {
+		return err
+	}
+	defer l.release(s)
+	l.prefetch(s, offset)
+	err := s.ReadInto(offset, rec)
+	l.failDir(s.dir, err)
+	return err
+}
+
+// prefetch notes a read of offset from s for read-ahead, which only applies
+// to sealed segments. The caller must hold l.mu.
+func (l *Log) prefetch(s *segment, offset uint64) {
+	if l.readAhead == nil || s == l.activeSegment {
+		return
+	}
+	var prev *segment
+	if offset == s.baseOffset && offset > 0 {
+		prev = l.segment(offset - 1)
+	}
+	l.readAhead.Read(l.ctx, prev, s, offset)
+}
+
+// segment returns the segment holding offset, or nil if it's out of range.
+func (l *Log) segment(offset uint64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return offset < l.segments[i].nextOffset
+	})
+	if i == len(l.segments) || offset < l.segments[i].baseOffset {
+		return nil
+	}
+	return l.segments[i]
 }
 
 func (l *Log) Append(rec *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	offset, err := l.activeSegment.Append(rec)
+	if offset, dup, err := l.producers.Check(rec); err != nil || dup {
+		return offset, err
+	}
+	return l.append(rec)
+}
+
+// AppendAt appends rec only if it gets offset expected, returning
+// ErrUnexpectedOffset otherwise. Writers use it to detect that others appended
+// since they last read the log. A retry from an idempotent producer still
+// returns the offset the record was first appended at.
+func (l *Log) AppendAt(expected uint64, rec *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset, dup, err := l.producers.Check(rec); err != nil || dup {
+		return offset, err
+	}
+	if next := l.activeSegment.nextOffset; next != expected {
+		return 0, api.ErrUnexpectedOffset{Expected: expected, Actual: next}
+	}
+	return l.append(rec)
+}
+
+// append appends rec to the active segment. The caller must hold l.mu.
+func (l *Log) append(rec *api.Record) (uint64, error) {
+	if err := l.rollIfExpired(); err != nil {
+		return 0, err
+	}
+	if !l.online(l.activeSegment.dir) {
+		if err := l.moveActive(); err != nil {
+			return 0, err
+		}
+	}
+	if rec.Key != "" {
+		rec.Version = l.streams.Next(rec.Key)
+	}
+	rec.Offset = l.activeSegment.nextOffset
+	rec.Timestamp = time.Now().UnixMilli()
+	n := uint64(proto.Size(rec)) + lenWidth
+	if err := l.checkQuota(n); err != nil {
+		return 0, err
+	}
+	prev := l.streams.Last(rec.Key)
+	offset, err := l.activeSegment.Append(rec, prev)
+	if l.failDir(l.activeSegment.dir, err) {
+		// Nothing was indexed, so the record can go in a segment elsewhere
+		if err = l.moveActive(); err != nil {
+			return 0, err
+		}
+		offset, err = l.activeSegment.Append(rec, prev)
+	}
 	if err != nil {
 		return 0, err
 	}
+	l.bytes += n
+	l.producers.Appended(rec)
+	l.streams.Appended(rec)
+	l.txns.Appended(rec)
+	l.cache.Put(rec)
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(offset + 1)
+		err = l.roll(offset + 1)
 	}
 	return offset, err
 }
 
+// Sync commits the records appended so far to disk, so that they survive a
+// crash. Otherwise they only reach it when the active segment rolls or is
+// checkpointed.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.activeSegment.Sync()
+}
+
+// Close closes every segment and records a clean checkpoint, so the next
+// setup can trust the segment files without validating them.
 func (l *Log) Close() error {
+	l.stop()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	// A segment in an offline directory can't be trusted after a restart
+	clean := true
+	if err := l.activeSegment.Sync(); err != nil {
+		if !l.failDir(l.activeSegment.dir, err) {
+			return err
+		}
+		clean = false
+	}
+	cp := l.newCheckpoint(clean)
 	for _, segment := range l.segments {
-		if err := segment.Close(); err != nil {
+		if err := segment.Close(); err != nil && !l.failDir(segment.dir, err) {
 			return err
 		}
 	}
-	return nil
+	if err := l.streams.Save(); err != nil {
+		return err
+	}
+	if err := l.streams.Close(); err != nil {
+		return err
+	}
+	return writeCheckpoint(l.Dir, cp)
 }
 
 func (l *Log) Remove() error {
 	if err := l.Close(); err != nil {
 		return err
 	}
-	return os.RemoveAll(l.Dir)
+	for _, d := range l.dirs {
+		if err := os.RemoveAll(d.path); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	l.cache.Reset()
 	return l.setup()
 }
 
@@ -146,21 +682,91 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return offset - 1, nil
 }
 
+// Truncate removes every segment whose records are all at or below
+// lowestCutoff. If that includes the active segment's records, it's rolled
+// first so that the log keeps an empty segment to append to.
 func (l *Log) Truncate(lowestCutoff uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	active := l.activeSegment
+	if active.nextOffset > active.baseOffset && active.nextOffset <= lowestCutoff+1 {
+		if err := l.roll(active.nextOffset); err != nil {
+			return err
+		}
+	}
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowestCutoff+1 {
+		if s != l.activeSegment && s.nextOffset <= lowestCutoff+1 {
+			l.open.Remove(s)
+			size := s.Size()
 			if err := s.Remove(); err != nil {
 				return err
 			}
+			l.bytes -= size
 			continue
 		}
 		segments = append(segments, s)
 	}
 	l.segments = segments
-	return nil
+	l.producers.Expire(segments[0].baseOffset)
+	l.txns.Truncate(segments[0].baseOffset)
+	return l.checkpoint(false)
+}
+
+// TruncateAfter removes every record with an offset greater than offset so
+// that a follower can discard the part of its log that diverged from the
+// leader. Segments are removed newest first so a crash part way through still
+// leaves a contiguous log behind.
+func (l *Log) TruncateAfter(offset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset < l.segments[0].baseOffset {
+		return api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	l.tailTruncations++
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		if s.baseOffset <= offset {
+			break
+		}
+		removed, err := s.keysAfter(offset)
+		if err != nil {
+			return err
+		}
+		l.streams.Removed(removed)
+		l.open.Remove(s)
+		size := s.Size()
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.bytes -= size
+		l.segments = l.segments[:i]
+	}
+	l.cache.TruncateAfter(offset)
+	l.producers.TruncateAfter(offset)
+	l.txns.TruncateAfter(offset)
+	// The segment holding offset becomes active again, so it must be open
+	// and no longer subject to the open segment budget
+	l.activeSegment = l.segments[len(l.segments)-1]
+	l.open.Remove(l.activeSegment)
+	if err := l.activeSegment.Unseal(); err != nil {
+		return err
+	}
+	removed, err := l.activeSegment.keysAfter(offset)
+	if err != nil {
+		return err
+	}
+	l.streams.Removed(removed)
+	size := l.activeSegment.Size()
+	if err := l.activeSegment.TruncateAfter(offset); err != nil {
+		return err
+	}
+	l.bytes -= size - l.activeSegment.Size()
+	if l.activeSegment.IsMaxed() {
+		return l.roll(l.activeSegment.nextOffset)
+	}
+	// The checkpoint may cover records that no longer exist
+	return l.checkpoint(false)
 }
 
 func (l *Log) Reader() io.Reader {
@@ -168,18 +774,25 @@ func (l *Log) Reader() io.Reader {
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = &originReader{l, segment, 0}
 	}
 	return io.MultiReader(readers...)
 }
 
 type originReader struct {
-	*store
+	log    *Log
+	s      *segment
 	offset int64
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.offset)
+	o.log.mu.RLock()
+	defer o.log.mu.RUnlock()
+	if err := o.log.acquire(o.s); err != nil {
+		return 0, err
+	}
+	defer o.log.release(o.s)
+	n, err := o.s.store.ReadAt(p, o.offset)
 	o.offset += int64(n)
 	return n, err
 }
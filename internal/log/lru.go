@@ -0,0 +1,110 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+)
+
+// segmentLRU tracks the open sealed segments so the log stays within its open
+// segment budget, closing the least recently read segments first. Segments
+// being read are pinned and never evicted, so a reader can't reopen a segment
+// after it was evicted and leave it open untracked. While more segments than
+// the budget are pinned the log goes over it, and the next Pin evicts the
+// surplus. A zero max disables tracking and segments stay open once read.
+type segmentLRU struct {
+	mu       sync.Mutex
+	max      int
+	order    *list.List
+	elements map[*segment]*list.Element
+}
+
+type lruEntry struct {
+	segment *segment
+	pins    int
+}
+
+func newSegmentLRU(max int) *segmentLRU {
+	return &segmentLRU{
+		max:      max,
+		order:    list.New(),
+		elements: make(map[*segment]*list.Element),
+	}
+}
+
+// Touch marks s as the most recently used segment and returns the segments
+// the caller must close to get back within budget.
+func (c *segmentLRU) Touch(s *segment) []*segment {
+	if c.max == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.touch(s)
+	return c.evict()
+}
+
+// Pin is like Touch but also keeps s from being evicted until Unpin is called
+// as many times as Pin was. s must be pinned before it's opened for a read.
+func (c *segmentLRU) Pin(s *segment) []*segment {
+	if c.max == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.touch(s).pins++
+	return c.evict()
+}
+
+// Unpin undoes a Pin. It's a no-op if s stopped being tracked in between.
+func (c *segmentLRU) Unpin(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.elements[s]; ok {
+		e.Value.(*lruEntry).pins--
+	}
+}
+
+// touch moves s to the front, tracking it if it isn't yet. The caller must
+// hold c.mu.
+func (c *segmentLRU) touch(s *segment) *lruEntry {
+	if e, ok := c.elements[s]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry)
+	}
+	entry := &lruEntry{segment: s}
+	c.elements[s] = c.order.PushFront(entry)
+	return entry
+}
+
+// evict stops tracking the least recently used unpinned segments until the
+// budget is met or only pinned ones are left, and returns them. The caller
+// must hold c.mu.
+func (c *segmentLRU) evict() []*segment {
+	var evicted []*segment
+	for e := c.order.Back(); e != nil && c.order.Len() > c.max; {
+		prev := e.Prev()
+		if entry := e.Value.(*lruEntry); entry.pins == 0 {
+			c.order.Remove(e)
+			delete(c.elements, entry.segment)
+			evicted = append(evicted, entry.segment)
+		}
+		e = prev
+	}
+	return evicted
+}
+
+// Remove stops tracking s, e.g. because it was removed or became active.
+func (c *segmentLRU) Remove(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.elements[s]; ok {
+		c.order.Remove(e)
+		delete(c.elements, s)
+	}
+}
+
+func (c *segmentLRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,135 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestMemoryLog(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, l *MemoryLog){
+		"append and read a record":  testMemoryAppendRead,
+		"offset out of range error": testMemoryOutOfRangeErr,
+		"truncate":                  testMemoryTruncate,
+		"truncate after":            testMemoryTruncateAfter,
+		"quota":                     testMemoryQuota,
+		"remove":                    testMemoryRemove,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c := Config{}
+			c.Segment.InitialOffset = 16
+			fn(t, NewMemoryLog(c))
+		})
+	}
+}
+
+func testMemoryAppendRead(t *testing.T, l *MemoryLog) {
+	append := &api.Record{Value: []byte("hello world")}
+	offset, err := l.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), offset)
+
+	// The log keeps its own copy
+	append.Value[0] = 'j'
+	read, err := l.Read(offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	require.Equal(t, offset, read.Offset)
+
+	read.Value = nil
+	require.NoError(t, l.ReadInto(offset, read))
+	require.Equal(t, []byte("hello world"), read.Value)
+}
+
+func testMemoryOutOfRangeErr(t *testing.T, l *MemoryLog) {
+	read, err := l.Read(16)
+	require.Nil(t, read)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 16}, err)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, l.ReadInto(0, &api.Record{}))
+}
+
+func testMemoryTruncate(t *testing.T, l *MemoryLog) {
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Truncate(17))
+	_, err := l.Read(17)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 17}, err)
+	_, err = l.Read(18)
+	require.NoError(t, err)
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(18), lowest)
+
+	// Truncating past the end leaves the next offset alone
+	require.NoError(t, l.Truncate(100))
+	offset, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), offset)
+}
+
+func testMemoryTruncateAfter(t *testing.T, l *MemoryLog) {
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.TruncateAfter(17))
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), highest)
+	_, err = l.Read(18)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 18}, err)
+	offset, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(18), offset)
+
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 15}, l.TruncateAfter(15))
+}
+
+func testMemoryQuota(t *testing.T, l *MemoryLog) {
+	append := &api.Record{Value: []byte("hello world")}
+	width := uint64(proto.Size(&api.Record{
+		Value:     append.Value,
+		Offset:    16,
+		Timestamp: time.Now().UnixMilli(),
+	})) + lenWidth
+	l.Config.Quota.MaxBytes = 2 * width
+	for i := 0; i < 2; i++ {
+		_, err := l.Append(append)
+		require.NoError(t, err)
+	}
+	_, err := l.Append(append)
+	require.Equal(t, api.ErrQuotaExceeded{Requested: width, Available: 0}, err)
+
+	// Appends resume once records are truncated
+	require.NoError(t, l.Truncate(16))
+	offset, err := l.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(18), offset)
+
+	require.NoError(t, l.Reset())
+	offset, err = l.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), offset)
+}
+
+func testMemoryRemove(t *testing.T, l *MemoryLog) {
+	id, err := l.InitProducer()
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Key: "order-42", ProducerId: id})
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("hello world"), TxnId: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, l.Remove())
+	_, err = l.Append(&api.Record{ProducerId: id, Sequence: 1})
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: id}, err)
+	_, err = l.AppendVersion(0, &api.Record{Key: "order-42"})
+	require.NoError(t, err)
+	require.Empty(t, l.txns.Open)
+}
@@ -0,0 +1,271 @@
+package log
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// MemoryLog is a commit log that keeps its records in memory, for tests and
+// ephemeral deployments. It behaves like Log except that nothing survives it
+// being closed, truncation isn't rounded to segment boundaries, and
+// Config.Quota.MaxBytes bounds the encoded size of the records it holds.
+type MemoryLog struct {
+	mu      sync.RWMutex
+	Config  Config
+	base    uint64
+	size    uint64
+	records []memoryRecord
+
+	producers *producers
+	streams   *streams
+	txns      *txns
+}
+
+type memoryRecord struct {
+	rec  *api.Record
+	size uint64
+}
+
+func NewMemoryLog(c Config) *MemoryLog {
+	return &MemoryLog{
+		Config:    c,
+		base:      c.Segment.InitialOffset,
+		producers: newProducers(),
+		streams:   newStreams(),
+		txns:      newTxns(),
+	}
+}
+
+// Append stores a copy of rec at the next offset.
+func (l *MemoryLog) Append(rec *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset, dup, err := l.producers.Check(rec); err != nil || dup {
+		return offset, err
+	}
+	return l.append(rec)
+}
+
+// AppendAt stores a copy of rec only if it gets offset expected.
+func (l *MemoryLog) AppendAt(expected uint64, rec *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset, dup, err := l.producers.Check(rec); err != nil || dup {
+		return offset, err
+	}
+	if next := l.base + uint64(len(l.records)); next != expected {
+		return 0, api.ErrUnexpectedOffset{Expected: expected, Actual: next}
+	}
+	return l.append(rec)
+}
+
+// AppendVersion stores a copy of rec only if it's the next version of its
+// key's stream.
+func (l *MemoryLog) AppendVersion(expected uint64, rec *api.Record) (uint64, error) {
+	if rec.Key == "" {
+		return 0, ErrNoKey
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset, dup, err := l.producers.Check(rec); err != nil || dup {
+		return offset, err
+	}
+	if next := l.streams.Next(rec.Key); next != expected {
+		return 0, api.ErrUnexpectedVersion{Key: rec.Key, Expected: expected, Actual: next}
+	}
+	return l.append(rec)
+}
+
+// StreamOffsets returns the offsets of key's records from version from
+// onwards, in order. The records are all in memory, so they're scanned rather
+// than indexed.
+func (l *MemoryLog) StreamOffsets(key string, from uint64) ([]uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var offsets []uint64
+	for _, r := range l.records {
+		if r.rec.Key == key && r.rec.Version >= from {
+			offsets = append(offsets, r.rec.Offset)
+		}
+	}
+	return offsets, nil
+}
+
+// append stores a copy of rec at the next offset. The caller must hold l.mu.
+func (l *MemoryLog) append(rec *api.Record) (uint64, error) {
+	offset := l.base + uint64(len(l.records))
+	rec.Offset = offset
+	if rec.Key != "" {
+		rec.Version = l.streams.Next(rec.Key)
+	}
+	rec.Timestamp = time.Now().UnixMilli()
+	// Sized like the disk log's store so quotas carry over between them
+	size := uint64(proto.Size(rec)) + lenWidth
+	if max := l.Config.Quota.MaxBytes; max > 0 && l.size+size > max {
+		return 0, api.ErrQuotaExceeded{Requested: size, Available: available(max, l.size)}
+	}
+	l.records = append(l.records, memoryRecord{
+		rec:  proto.Clone(rec).(*api.Record),
+		size: size,
+	})
+	l.size += size
+	l.producers.Appended(rec)
+	l.streams.Appended(rec)
+	l.txns.Appended(rec)
+	return offset, nil
+}
+
+// InitProducer registers a new idempotent producer and returns its ID.
+func (l *MemoryLog) InitProducer() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.producers.Init(l.base + uint64(len(l.records))), nil
+}
+
+// Read returns a copy of the record at offset.
+func (l *MemoryLog) Read(offset uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	r, ok := l.record(offset)
+	if !ok {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	return proto.Clone(r.rec).(*api.Record), nil
+}
+
+// ReadInto copies the record at offset into rec.
+func (l *MemoryLog) ReadInto(offset uint64, rec *api.Record) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	r, ok := l.record(offset)
+	if !ok {
+		return api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	proto.Reset(rec)
+	proto.Merge(rec, r.rec)
+	return nil
+}
+
+// ReadCommitted returns a copy of the first record at or after offset that's
+// visible to read-committed readers.
+func (l *MemoryLog) ReadCommitted(offset uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stable := l.txns.Stable(l.base + uint64(len(l.records)))
+	for o := offset; o < stable; o++ {
+		r, ok := l.record(o)
+		if !ok {
+			break
+		}
+		if !l.txns.Hidden(r.rec) {
+			return proto.Clone(r.rec).(*api.Record), nil
+		}
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: offset}
+}
+
+// record returns the record at offset. The caller must hold l.mu.
+func (l *MemoryLog) record(offset uint64) (memoryRecord, bool) {
+	if offset < l.base || offset >= l.base+uint64(len(l.records)) {
+		return memoryRecord{}, false
+	}
+	return l.records[offset-l.base], true
+}
+
+func (l *MemoryLog) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.base, nil
+}
+
+func (l *MemoryLog) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	offset := l.base + uint64(len(l.records))
+	if offset == 0 {
+		return 0, nil
+	}
+	return offset - 1, nil
+}
+
+// Truncate removes every record with an offset up to and including
+// lowestCutoff.
+func (l *MemoryLog) Truncate(lowestCutoff uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.records)
+	if lowestCutoff < l.base {
+		return nil
+	}
+	if i := lowestCutoff + 1 - l.base; i < uint64(n) {
+		n = int(i)
+	}
+	for _, r := range l.records[:n] {
+		l.size -= r.size
+	}
+	// Copy what's left so the truncated records can be collected
+	l.records = append([]memoryRecord(nil), l.records[n:]...)
+	l.base += uint64(n)
+	l.producers.Expire(l.base)
+	l.txns.Truncate(l.base)
+	return nil
+}
+
+// TruncateAfter removes every record with an offset greater than offset.
+func (l *MemoryLog) TruncateAfter(offset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset < l.base {
+		return api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	n := offset + 1 - l.base
+	if n >= uint64(len(l.records)) {
+		return nil
+	}
+	var removed []keyEntry
+	for i, r := range l.records[n:] {
+		if r.rec.Key != "" {
+			removed = append(removed, keyEntry{Key: r.rec.Key, Version: r.rec.Version, Offset: r.rec.Offset})
+		}
+		l.size -= r.size
+		l.records[n+uint64(i)] = memoryRecord{}
+	}
+	l.records = l.records[:n]
+	l.producers.TruncateAfter(offset)
+	l.streams.Removed(removed)
+	l.txns.TruncateAfter(offset)
+	return nil
+}
+
+// Close is a no-op, the records stay readable until the log is garbage
+// collected.
+func (l *MemoryLog) Close() error {
+	return nil
+}
+
+// Remove drops every record along with the producers, streams and
+// transactions they made up, as removing a Log's files does.
+func (l *MemoryLog) Remove() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records, l.size = nil, 0
+	l.producers = newProducers()
+	l.streams = newStreams()
+	l.txns = newTxns()
+	return nil
+}
+
+// Reset drops every record and starts over from the initial offset.
+func (l *MemoryLog) Reset() error {
+	if err := l.Remove(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.base = l.Config.Segment.InitialOffset
+	return nil
+}
@@ -0,0 +1,167 @@
+package log
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestMerge(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, l *Log){
+		"merge small segments":      testMerge,
+		"finish interrupted merge":  testFinishMerge,
+		"discard incomplete merge":  testDiscardMerge,
+		"skip truncated merge runs": testMergeTruncated,
+		"truncate while copying":    testMergeTruncatedWhileCopying,
+		"skip rewritten merge runs": testMergeRewritten,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "merge-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			l, err := NewLog(dir, c)
+			require.NoError(t, err)
+			// Roll after every other record to leave small sealed segments
+			append := &api.Record{Value: []byte("hello world")}
+			for i := uint64(0); i < 8; i++ {
+				_, err := l.Append(append)
+				require.NoError(t, err)
+				if i%2 == 1 {
+					l.mu.Lock()
+					require.NoError(t, l.roll(i+1))
+					l.mu.Unlock()
+				}
+			}
+			require.Equal(t, 5, len(l.segments))
+			fn(t, l)
+		})
+	}
+}
+
+func testMerge(t *testing.T, l *Log) {
+	createdAt := l.segments[0].createdAt
+	require.NoError(t, l.merge())
+	require.Equal(t, 2, len(l.segments))
+	require.Equal(t, uint64(0), l.segments[0].baseOffset)
+	require.Equal(t, uint64(8), l.segments[0].nextOffset)
+	require.True(t, createdAt.Equal(l.segments[0].createdAt))
+	requireRecords(t, l, 8)
+	requireBytes(t, l)
+	_, err := os.Stat(path.Join(l.Dir, mergeDir))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, l.Close())
+	l, err = NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(l.segments))
+	require.Equal(t, l.segments[0].size, l.newCheckpoint(false).Segments[0].StoreSize)
+	requireRecords(t, l, 8)
+	offset, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), offset)
+}
+
+func testFinishMerge(t *testing.T, l *Log) {
+	// Crash after the merged segment was complete but before it was swapped in
+	run := l.mergeCandidates()
+	dir := path.Join(l.Dir, mergeDir)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	merged, err := l.writeMerged(dir, run)
+	require.NoError(t, err)
+	b, err := json.Marshal(mergeRange{merged.baseOffset, merged.nextOffset})
+	require.NoError(t, err)
+	require.NoError(t, writeFileSync(path.Join(dir, mergeMarker), b))
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(l.segments))
+	requireRecords(t, l, 8)
+}
+
+func testDiscardMerge(t *testing.T, l *Log) {
+	// Crash while the merged segment was being written
+	run := l.mergeCandidates()
+	dir := path.Join(l.Dir, mergeDir)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	_, err := l.writeMerged(dir, run)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(l.segments))
+	requireRecords(t, l, 8)
+	_, err = os.Stat(dir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func testMergeTruncated(t *testing.T, l *Log) {
+	run := l.mergeCandidates()
+	require.NoError(t, l.Truncate(1))
+	require.Equal(t, -1, l.segmentIndex(run))
+	require.NoError(t, l.merge())
+	require.Equal(t, 2, len(l.segments))
+	require.Equal(t, uint64(2), l.segments[0].baseOffset)
+	require.Equal(t, uint64(8), l.segments[0].nextOffset)
+}
+
+func testMergeTruncatedWhileCopying(t *testing.T, l *Log) {
+	run := l.mergeCandidates()
+	src, positions, _, err := l.snapshot(run[0])
+	require.NoError(t, err)
+	defer src.File.Close()
+
+	// Nothing is held while copying, so truncating doesn't wait for it and
+	// the copy carries on from the removed segment's file
+	require.NoError(t, l.Truncate(1))
+	require.Equal(t, -1, l.segmentIndex(run))
+	p, err := src.Read(positions[1])
+	require.NoError(t, err)
+	rec := &api.Record{}
+	require.NoError(t, proto.Unmarshal(p, rec))
+	require.Equal(t, uint64(1), rec.Offset)
+}
+
+func testMergeRewritten(t *testing.T, l *Log) {
+	run, tailTruncations := l.mergeCandidates(), l.tailTruncations
+	dir := path.Join(l.Dir, mergeDir)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	merged, err := l.writeMerged(dir, run)
+	require.NoError(t, err)
+
+	// Rewrite the run's last record while leaving its segments in place
+	require.NoError(t, l.TruncateAfter(6))
+	_, err = l.Append(&api.Record{Value: []byte("rewritten")})
+	require.NoError(t, err)
+	l.mu.Lock()
+	require.NoError(t, l.roll(8))
+	l.mu.Unlock()
+	require.Equal(t, 0, l.segmentIndex(run))
+
+	require.NoError(t, l.installMerged(dir, run, merged, tailTruncations))
+	require.Equal(t, 5, len(l.segments))
+	read, err := l.Read(7)
+	require.NoError(t, err)
+	require.Equal(t, []byte("rewritten"), read.Value)
+	_, err = os.Stat(dir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func requireRecords(t *testing.T, l *Log, n uint64) {
+	t.Helper()
+	for i := uint64(0); i < n; i++ {
+		read, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+}
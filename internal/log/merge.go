@@ -0,0 +1,293 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+const (
+	mergeDir    = "merge"
+	mergeMarker = "merged"
+)
+
+// mergeRange is written to the merge directory once the merged segment is
+// complete. From then on the merge is finished after a crash instead of being
+// thrown away.
+type mergeRange struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+}
+
+// merge rewrites the first run of adjacent small sealed segments in the same
+// directory into a single segment with the same offsets. Sealed segments never
+// change, so records are copied without holding the log's lock or the
+// segments', and the log's lock is only taken to swap the merged segment in.
+func (l *Log) merge() error {
+	l.mu.RLock()
+	run, tailTruncations := l.mergeCandidates(), l.tailTruncations
+	l.mu.RUnlock()
+	if len(run) < 2 {
+		return nil
+	}
+
+	dir := path.Join(run[0].dir, mergeDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	merged, err := l.writeMerged(dir, run)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return l.installMerged(dir, run, merged, tailTruncations)
+}
+
+// installMerged replaces run with the merged segment written to dir, unless
+// the run was truncated since merge picked it. tailTruncations is what
+// l.tailTruncations was then.
+func (l *Log) installMerged(dir string, run []*segment, merged *segment, tailTruncations uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.segmentIndex(run)
+	// Truncating the tail may have rewritten the run's last records in the
+	// same segments
+	if i < 0 || l.tailTruncations != tailTruncations {
+		return os.RemoveAll(dir)
+	}
+	b, err := json.Marshal(mergeRange{
+		BaseOffset: merged.baseOffset,
+		NextOffset: merged.nextOffset,
+	})
+	if err != nil {
+		return err
+	}
+	if err = writeFileSync(path.Join(dir, mergeMarker), b); err != nil {
+		return err
+	}
+	if err = syncDir(dir); err != nil {
+		return err
+	}
+	for _, s := range run {
+		l.open.Remove(s)
+		l.bytes -= s.Size()
+		if err = s.Discard(); err != nil {
+			return err
+		}
+	}
+	l.bytes += merged.size
+	if err = l.swapMerged(run[0].dir, merged.baseOffset, merged.nextOffset); err != nil {
+		return err
+	}
+	s := newSealedSegment(
+		run[0].dir, merged.baseOffset, merged.nextOffset, merged.size, l.Config,
+	)
+	s.createdAt = run[0].createdAt
+	segments := append([]*segment{}, l.segments[:i]...)
+	segments = append(segments, s)
+	l.segments = append(segments, l.segments[i+len(run):]...)
+	return l.checkpoint(false)
+}
+
+// mergeCandidates returns the first run of adjacent small sealed segments that
+// share an online directory and fit in one segment. The caller must hold l.mu.
+func (l *Log) mergeCandidates() []*segment {
+	small := l.Config.Merge.SmallSegmentBytes
+	if small == 0 {
+		small = l.Config.Segment.MaxStoreBytes / 2
+	}
+	maxEntries := l.Config.Segment.MaxIndexBytes / entryWidth
+	var run []*segment
+	var size, entries uint64
+	for _, s := range l.segments[:len(l.segments)-1] {
+		n := s.nextOffset - s.baseOffset
+		fits := size+s.Size() <= l.Config.Segment.MaxStoreBytes &&
+			entries+n <= maxEntries &&
+			(run == nil || s.dir == run[0].dir)
+		skip := s.Size() >= small || !l.online(s.dir)
+		if skip || !fits {
+			if len(run) >= 2 {
+				return run
+			}
+			run, size, entries = nil, 0, 0
+			if skip {
+				continue
+			}
+		}
+		run = append(run, s)
+		size += s.Size()
+		entries += n
+	}
+	return run
+}
+
+// segmentIndex returns where run starts in l.segments, or -1 if the segments
+// aren't there as a sealed run anymore. The caller must hold l.mu.
+func (l *Log) segmentIndex(run []*segment) int {
+	for i, s := range l.segments {
+		if s != run[0] {
+			continue
+		}
+		if i+len(run) >= len(l.segments) {
+			return -1
+		}
+		for j, r := range run {
+			if l.segments[i+j] != r || !r.sealed {
+				return -1
+			}
+		}
+		return i
+	}
+	return -1
+}
+
+// writeMerged copies run's records into a new sealed segment in dir. Each
+// segment is only acquired to note where its records are and to open its store
+// file again for the copy, so truncating the log doesn't wait for the copy to
+// finish.
+func (l *Log) writeMerged(dir string, run []*segment) (*segment, error) {
+	merged, err := newSegment(dir, run[0].baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer merged.Close()
+	rec := &api.Record{}
+	var p []byte
+	for _, s := range run {
+		src, positions, keys, err := l.snapshot(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, pos := range positions {
+			if p, err = src.ReadInto(pos, p); err != nil {
+				break
+			}
+			if err = proto.Unmarshal(p, rec); err != nil {
+				break
+			}
+			// The keyed records' entries point at the same records as
+			// before
+			var prev uint64
+			if rec.Key != "" && len(keys) > 0 && keys[0].Offset == rec.Offset {
+				prev, keys = keys[0].Prev, keys[1:]
+			}
+			if _, err = merged.Append(rec, prev); err != nil {
+				break
+			}
+		}
+		src.File.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = merged.Seal(); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// snapshot opens sealed segment s's store file for reading on its own and
+// returns it with the positions of s's records in it and its key index
+// entries. The file stays readable even if s is removed in the meantime.
+func (l *Log) snapshot(s *segment) (*store, []uint64, []keyEntry, error) {
+	l.mu.RLock()
+	err := l.acquire(s)
+	l.mu.RUnlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer l.release(s)
+	positions := make([]uint64, 0, s.nextOffset-s.baseOffset)
+	for i := uint64(0); i < s.nextOffset-s.baseOffset; i++ {
+		_, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		positions = append(positions, pos)
+	}
+	f, err := os.Open(s.path(".store"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	src, err := newStore(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	return src, positions, s.keys.From(s.baseOffset), nil
+}
+
+// swapMerged moves the merged segment's files in segmentDir over the first
+// segment of the range it replaces and removes the rest of the range's
+// segments. It's idempotent so that it can be redone if we crash part way
+// through.
+func (l *Log) swapMerged(segmentDir string, baseOffset, nextOffset uint64) error {
+	dir := path.Join(segmentDir, mergeDir)
+	for _, ext := range []string{".keys", ".index", ".store"} {
+		s := &segment{dir: dir, baseOffset: baseOffset}
+		err := os.Rename(s.path(ext), path.Join(segmentDir, path.Base(s.path(ext))))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	baseOffsets, err := segmentBaseOffsets(segmentDir)
+	if err != nil {
+		return err
+	}
+	for _, offset := range baseOffsets {
+		if offset <= baseOffset || offset >= nextOffset {
+			continue
+		}
+		s := &segment{dir: segmentDir, baseOffset: offset}
+		for _, ext := range []string{".keys", ".index", ".store"} {
+			if err = os.Remove(s.path(ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	if err = syncDir(segmentDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// finishMerge completes merges interrupted by a crash if the merged segment
+// was complete, and otherwise throws the partial merge away.
+func (l *Log) finishMerge() error {
+	for _, d := range l.dirs {
+		if d.offline.Load() {
+			continue
+		}
+		err := l.finishMergeIn(d.path)
+		if l.failDir(d.path, err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Log) finishMergeIn(segmentDir string) error {
+	b, err := os.ReadFile(path.Join(segmentDir, mergeDir, mergeMarker))
+	if errors.Is(err, os.ErrNotExist) {
+		return os.RemoveAll(path.Join(segmentDir, mergeDir))
+	}
+	if err != nil {
+		return err
+	}
+	var r mergeRange
+	if err = json.Unmarshal(b, &r); err != nil {
+		return err
+	}
+	return l.swapMerged(segmentDir, r.BaseOffset, r.NextOffset)
+}
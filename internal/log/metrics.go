@@ -0,0 +1,101 @@
+package log
+
+import (
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	keyDir = tag.MustNewKey("yojimbo_log_dir")
+
+	cacheHits = stats.Int64(
+		"yojimbo/log/cache_hits",
+		"Number of reads served from the record cache",
+		stats.UnitDimensionless,
+	)
+	cacheMisses = stats.Int64(
+		"yojimbo/log/cache_misses",
+		"Number of reads that missed the record cache and went to disk",
+		stats.UnitDimensionless,
+	)
+	readAheadBytes = stats.Int64(
+		"yojimbo/log/read_ahead_bytes",
+		"Number of store bytes prefetched for sequential readers",
+		stats.UnitBytes,
+	)
+	readAheadHits = stats.Int64(
+		"yojimbo/log/read_ahead_hits",
+		"Number of sequential reads of records that had been prefetched",
+		stats.UnitDimensionless,
+	)
+	readAheadMisses = stats.Int64(
+		"yojimbo/log/read_ahead_misses",
+		"Number of sequential reads of records that hadn't been prefetched",
+		stats.UnitDimensionless,
+	)
+	scrubbedSegments = stats.Int64(
+		"yojimbo/log/scrubbed_segments",
+		"Number of sealed segments verified by the scrubber",
+		stats.UnitDimensionless,
+	)
+	corruptRecords = stats.Int64(
+		"yojimbo/log/corrupt_records",
+		"Number of corrupt records found by the scrubber",
+		stats.UnitDimensionless,
+	)
+)
+
+// Views aggregates the log's measures by log directory. Register them with
+// view.Register to export them alongside the server's views.
+var Views = []*view.View{
+	{
+		Name:        cacheHits.Name(),
+		Description: cacheHits.Description(),
+		Measure:     cacheHits,
+		TagKeys:     []tag.Key{keyDir},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        cacheMisses.Name(),
+		Description: cacheMisses.Description(),
+		Measure:     cacheMisses,
+		TagKeys:     []tag.Key{keyDir},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        readAheadBytes.Name(),
+		Description: readAheadBytes.Description(),
+		Measure:     readAheadBytes,
+		TagKeys:     []tag.Key{keyDir},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        readAheadHits.Name(),
+		Description: readAheadHits.Description(),
+		Measure:     readAheadHits,
+		TagKeys:     []tag.Key{keyDir},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        readAheadMisses.Name(),
+		Description: readAheadMisses.Description(),
+		Measure:     readAheadMisses,
+		TagKeys:     []tag.Key{keyDir},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        scrubbedSegments.Name(),
+		Description: scrubbedSegments.Description(),
+		Measure:     scrubbedSegments,
+		TagKeys:     []tag.Key{keyDir},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        corruptRecords.Name(),
+		Description: corruptRecords.Description(),
+		Measure:     corruptRecords,
+		TagKeys:     []tag.Key{keyDir},
+		Aggregation: view.Sum(),
+	},
+}
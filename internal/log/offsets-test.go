@@ -0,0 +1,75 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsets(t *testing.T) {
+	dir, err := os.MkdirTemp("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 16
+	o, err := NewOffsets(dir, c)
+	require.NoError(t, err)
+	a := OffsetKey{Group: "a", Log: "orders"}
+	b := OffsetKey{Group: "b", Log: "orders"}
+	_, ok := o.Fetch(a)
+	require.False(t, ok)
+
+	// Enough commits to compact the log a few times
+	for i := uint64(0); i < 3*compactSlack; i++ {
+		require.NoError(t, o.Commit(a, i))
+	}
+	require.NoError(t, o.Commit(b, 7))
+	lowest, err := o.log.LowestOffset()
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+	require.LessOrEqual(t, o.appended, len(o.committed)+compactSlack)
+	require.NoError(t, o.Close())
+
+	o, err = NewOffsets(dir, c)
+	require.NoError(t, err)
+	offset, ok := o.Fetch(a)
+	require.True(t, ok)
+	require.Equal(t, uint64(3*compactSlack-1), offset)
+	offset, ok = o.Fetch(b)
+	require.True(t, ok)
+	require.Equal(t, uint64(7), offset)
+	require.NoError(t, o.Close())
+}
+
+func TestOffsetsPositions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	o, err := NewOffsets(dir, Config{})
+	require.NoError(t, err)
+	defer o.Close()
+	now := time.Now()
+	o.now = func() time.Time { return now }
+
+	a := OffsetKey{Group: "a", Log: "orders"}
+	b := OffsetKey{Group: "b", Log: "orders"}
+	require.NoError(t, o.Commit(b, 3))
+	require.NoError(t, o.Commit(a, 10))
+	require.Equal(t, []Position{{OffsetKey: a, Offset: 10}}, o.Positions("a"))
+
+	now = now.Add(2 * time.Second)
+	require.NoError(t, o.Commit(a, 30))
+	require.Equal(t, []Position{
+		{OffsetKey: a, Offset: 30, Rate: 10},
+		{OffsetKey: b, Offset: 3},
+	}, o.Positions(""))
+
+	// Rewinding forgets the rate
+	now = now.Add(time.Second)
+	require.NoError(t, o.Commit(a, 5))
+	require.Equal(t, []Position{{OffsetKey: a, Offset: 5}}, o.Positions("a"))
+}
@@ -0,0 +1,214 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// compactSlack is how many superseded commits the offsets log holds beyond
+// one per group, log and partition before it's compacted.
+const compactSlack = 1024
+
+// OffsetKey identifies the position a consumer group commits in a log
+// partition.
+type OffsetKey struct {
+	Group     string `json:"group"`
+	Log       string `json:"log"`
+	Partition uint32 `json:"partition"`
+}
+
+// Position is the offset a group committed for a partition.
+type Position struct {
+	OffsetKey
+	Offset uint64
+	// Rate estimates how many records a second the group consumes from the
+	// partition, from its last two commits since the offsets were opened.
+	// It's zero until then.
+	Rate float64
+}
+
+// offsetCommit is a record in the offsets log.
+type offsetCommit struct {
+	OffsetKey
+	Offset uint64 `json:"offset"`
+}
+
+// Offsets stores the offsets consumer groups commit in a log of its own, so
+// that consumers resume where their group left off. Only the latest commit for
+// each key matters, so the log is compacted by appending those again and
+// truncating what came before.
+type Offsets struct {
+	mu        sync.RWMutex
+	log       *Log
+	committed map[OffsetKey]uint64
+	// appended counts the commits in the log, superseded ones included.
+	appended int
+	// committedAt is when each key was last committed to, and rates how
+	// fast its offset advanced by then. Neither is persisted.
+	committedAt map[OffsetKey]time.Time
+	rates       map[OffsetKey]float64
+	// now is the clock commits are timed by.
+	now func() time.Time
+}
+
+// NewOffsets opens the offsets log in dir and reads back the offsets committed
+// to it.
+func NewOffsets(dir string, c Config) (*Offsets, error) {
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	o := &Offsets{
+		log:         l,
+		committed:   make(map[OffsetKey]uint64),
+		committedAt: make(map[OffsetKey]time.Time),
+		rates:       make(map[OffsetKey]float64),
+		now:         time.Now,
+	}
+	if err = o.load(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Offsets) load() error {
+	offset, err := o.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	rec := &api.Record{}
+	for ; ; offset++ {
+		err := o.log.ReadInto(offset, rec)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var c offsetCommit
+		if err = json.Unmarshal(rec.Value, &c); err != nil {
+			return err
+		}
+		// Later commits supersede earlier ones
+		o.committed[c.OffsetKey] = c.Offset
+		o.appended++
+	}
+}
+
+// Commit records offset as where the group resumes reading the partition.
+func (o *Offsets) Commit(key OffsetKey, offset uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.append(offsetCommit{OffsetKey: key, Offset: offset}); err != nil {
+		return err
+	}
+	now := o.now()
+	prev := o.committed[key]
+	if at, ok := o.committedAt[key]; ok && offset >= prev {
+		if elapsed := now.Sub(at).Seconds(); elapsed > 0 {
+			o.rates[key] = float64(offset-prev) / elapsed
+		}
+	} else {
+		// A group that rewinds starts over
+		delete(o.rates, key)
+	}
+	o.committed[key] = offset
+	o.committedAt[key] = now
+	if o.appended > len(o.committed)+compactSlack {
+		return o.compact()
+	}
+	return nil
+}
+
+// Fetch returns the offset the group last committed for the partition, if
+// it's committed one.
+func (o *Offsets) Fetch(key OffsetKey) (uint64, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	offset, ok := o.committed[key]
+	return offset, ok
+}
+
+// Positions returns the positions the group committed, or those of every
+// group if it's empty, sorted by group, log and partition.
+func (o *Offsets) Positions(group string) []Position {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	var positions []Position
+	for key, offset := range o.committed {
+		if group != "" && key.Group != group {
+			continue
+		}
+		positions = append(positions, Position{
+			OffsetKey: key,
+			Offset:    offset,
+			Rate:      o.rates[key],
+		})
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		a, b := positions[i].OffsetKey, positions[j].OffsetKey
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Log != b.Log {
+			return a.Log < b.Log
+		}
+		return a.Partition < b.Partition
+	})
+	return positions
+}
+
+// append appends c to the offsets log. The caller must hold o.mu.
+func (o *Offsets) append(c offsetCommit) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, err = o.log.Append(&api.Record{Value: b}); err != nil {
+		return err
+	}
+	o.appended++
+	return nil
+}
+
+// compact appends the latest commit for every key again and truncates the
+// commits before them. A crash in between leaves both copies, which read back
+// the same. The caller must hold o.mu.
+func (o *Offsets) compact() error {
+	last, err := o.log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	for key, offset := range o.committed {
+		if err = o.append(offsetCommit{OffsetKey: key, Offset: offset}); err != nil {
+			return err
+		}
+	}
+	if err = o.log.Truncate(last); err != nil {
+		return err
+	}
+	// Truncation keeps the segment the copies start in
+	lowest, err := o.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	highest, err := o.log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	o.appended = int(highest - lowest + 1)
+	return nil
+}
+
+// Close closes the offsets log.
+func (o *Offsets) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.log.Close()
+}
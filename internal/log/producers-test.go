@@ -0,0 +1,121 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestProducers(t *testing.T) {
+	p := newProducers()
+	id := p.Init(0)
+	for seq := uint64(0); seq < producerWindow+2; seq++ {
+		rec := &api.Record{ProducerId: id, Sequence: seq, Offset: seq * 10}
+		_, dup, err := p.Check(rec)
+		require.NoError(t, err)
+		require.False(t, dup)
+		p.Appended(rec)
+	}
+
+	// Only the latest records are remembered
+	_, _, err := p.Check(&api.Record{ProducerId: id, Sequence: 1})
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerID: id, Expected: 7, Sequence: 1}, err)
+	offset, dup, err := p.Check(&api.Record{ProducerId: id, Sequence: 2})
+	require.NoError(t, err)
+	require.True(t, dup)
+	require.Equal(t, uint64(20), offset)
+
+	// Truncated records have to be sent again
+	p.TruncateAfter(40)
+	require.Equal(t, uint64(5), p.States[id].Next)
+	_, dup, err = p.Check(&api.Record{ProducerId: id, Sequence: 5})
+	require.NoError(t, err)
+	require.False(t, dup)
+
+	// Producers are forgotten once their latest record is truncated, even if
+	// they never appended
+	idle := p.Init(70)
+	p.Expire(41)
+	require.Contains(t, p.States, idle)
+	require.Contains(t, p.States, id)
+	p.Expire(61)
+	require.NotContains(t, p.States, id)
+	require.Contains(t, p.States, idle)
+	p.Expire(71)
+	require.Empty(t, p.States)
+	_, _, err = p.Check(&api.Record{ProducerId: idle})
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: idle}, err)
+	require.Equal(t, idle+1, p.Init(71))
+}
+
+func TestLogProducersRecover(t *testing.T) {
+	dir, err := os.MkdirTemp("", "producers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	id, err := l.InitProducer()
+	require.NoError(t, err)
+	cp, err := os.ReadFile(path.Join(dir, checkpointFile))
+	require.NoError(t, err)
+	for seq := uint64(0); seq < 3; seq++ {
+		_, err = l.Append(&api.Record{ProducerId: id, Sequence: seq})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// The records appended since the checkpoint are replayed
+	require.NoError(t, os.WriteFile(path.Join(dir, checkpointFile), cp, 0644))
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	offset, err := l.Append(&api.Record{ProducerId: id, Sequence: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+	offset, err = l.Append(&api.Record{ProducerId: id, Sequence: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	require.NoError(t, l.Close())
+}
+
+func TestLogProducersExpire(t *testing.T) {
+	dir, err := os.MkdirTemp("", "producers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	gone, err := l.InitProducer()
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{ProducerId: gone})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	active, err := l.InitProducer()
+	require.NoError(t, err)
+	offset, err := l.Append(&api.Record{ProducerId: active})
+	require.NoError(t, err)
+
+	require.NoError(t, l.Truncate(offset-1))
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+	require.NoError(t, l.Close())
+
+	// Expiry is checkpointed
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.Append(&api.Record{ProducerId: gone, Sequence: 1})
+	require.Equal(t, api.ErrUnknownProducer{ProducerID: gone}, err)
+	_, err = l.Append(&api.Record{ProducerId: active, Sequence: 1})
+	require.NoError(t, err)
+}
@@ -0,0 +1,157 @@
+package log
+
+import (
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// producerWindow is how many of each producer's latest records are remembered
+// so that retries of them return their original offsets.
+const producerWindow = 5
+
+// producers deduplicates records from idempotent producers. Each producer
+// numbers its records from 0 and a record with a sequence number that was
+// already appended is answered with the offset it was appended at instead of
+// being appended again. Producers are forgotten once the log is truncated past
+// their latest record, so that ones that went away don't pile up.
+type producers struct {
+	// NextID is the ID handed to the next producer to register. IDs start
+	// at 1 since records with producer ID 0 aren't deduplicated.
+	NextID uint64                    `json:"next_id"`
+	States map[uint64]*producerState `json:"states"`
+}
+
+type producerState struct {
+	// Next is the sequence number expected from the producer next.
+	Next uint64 `json:"next"`
+	// Recent holds the producer's latest records, oldest first.
+	Recent []producerRecord `json:"recent"`
+	// Last is the offset of the producer's latest record, or the log's next
+	// offset when it registered if it hasn't appended any.
+	Last uint64 `json:"last"`
+}
+
+type producerRecord struct {
+	Sequence uint64 `json:"sequence"`
+	Offset   uint64 `json:"offset"`
+}
+
+func newProducers() *producers {
+	return &producers{
+		NextID: 1,
+		States: make(map[uint64]*producerState),
+	}
+}
+
+// Init registers a new producer with the log at next and returns its ID.
+func (p *producers) Init(next uint64) uint64 {
+	id := p.NextID
+	p.NextID++
+	p.States[id] = &producerState{Last: next}
+	return id
+}
+
+// Check returns the offset rec was appended at, also setting rec.Offset, if
+// it's a retry of a record already appended, or an error if rec can't be
+// appended in sequence.
+func (p *producers) Check(rec *api.Record) (uint64, bool, error) {
+	if rec.ProducerId == 0 {
+		return 0, false, nil
+	}
+	st, ok := p.States[rec.ProducerId]
+	if !ok {
+		return 0, false, api.ErrUnknownProducer{ProducerID: rec.ProducerId}
+	}
+	if rec.Sequence == st.Next {
+		return 0, false, nil
+	}
+	for _, r := range st.Recent {
+		if r.Sequence == rec.Sequence {
+			rec.Offset = r.Offset
+			return r.Offset, true, nil
+		}
+	}
+	return 0, false, api.ErrOutOfOrderSequence{
+		ProducerID: rec.ProducerId,
+		Expected:   st.Next,
+		Sequence:   rec.Sequence,
+	}
+}
+
+// Appended notes that rec was appended. Records are replayed through it when
+// recovering, so producers it hasn't seen are registered.
+func (p *producers) Appended(rec *api.Record) {
+	if rec.ProducerId == 0 {
+		return
+	}
+	st, ok := p.States[rec.ProducerId]
+	if !ok {
+		st = &producerState{}
+		p.States[rec.ProducerId] = st
+	}
+	if rec.ProducerId >= p.NextID {
+		p.NextID = rec.ProducerId + 1
+	}
+	st.Next = rec.Sequence + 1
+	st.Last = rec.Offset
+	st.Recent = append(st.Recent, producerRecord{
+		Sequence: rec.Sequence,
+		Offset:   rec.Offset,
+	})
+	if len(st.Recent) > producerWindow {
+		copy(st.Recent, st.Recent[1:])
+		st.Recent = st.Recent[:producerWindow]
+	}
+}
+
+// TruncateAfter forgets the records after offset, so that producers resend
+// them.
+func (p *producers) TruncateAfter(offset uint64) {
+	for _, st := range p.States {
+		for i, r := range st.Recent {
+			if r.Offset > offset {
+				// Expect the first removed record again
+				st.Next = r.Sequence
+				st.Recent = append([]producerRecord(nil), st.Recent[:i]...)
+				break
+			}
+		}
+	}
+}
+
+// Expire forgets the producers whose latest record is before lowest, the
+// log's lowest offset after truncating it. Their IDs aren't handed out again.
+func (p *producers) Expire(lowest uint64) {
+	for id, st := range p.States {
+		if st.Last < lowest {
+			delete(p.States, id)
+		}
+	}
+}
+
+// Clone returns a deep copy of p, e.g. to snapshot it in a checkpoint.
+func (p *producers) Clone() *producers {
+	c := &producers{
+		NextID: p.NextID,
+		States: make(map[uint64]*producerState, len(p.States)),
+	}
+	for id, st := range p.States {
+		c.States[id] = &producerState{
+			Next:   st.Next,
+			Recent: append([]producerRecord(nil), st.Recent...),
+			Last:   st.Last,
+		}
+	}
+	return c
+}
+
+// InitProducer registers a new idempotent producer and returns its ID. The ID
+// is checkpointed before it's returned so it's never handed out twice.
+func (l *Log) InitProducer() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.producers.Init(l.activeSegment.nextOffset)
+	if err := l.checkpoint(false); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
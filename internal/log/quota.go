@@ -0,0 +1,34 @@
+package log
+
+import (
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// checkQuota refuses to append n bytes if that would take the log past its
+// byte quota or the active segment's disk below the free space floor. Both are
+// checked on every append, so appends resume on their own once retention frees
+// space. The caller must hold l.mu.
+func (l *Log) checkQuota(n uint64) error {
+	q := l.Config.Quota
+	if q.MaxBytes > 0 && l.bytes+n > q.MaxBytes {
+		return api.ErrQuotaExceeded{Requested: n, Available: available(q.MaxBytes, l.bytes)}
+	}
+	if q.MinFreeBytes > 0 {
+		free, err := freeBytes(l.activeSegment.dir)
+		if err != nil {
+			return err
+		}
+		if free < q.MinFreeBytes+n {
+			return api.ErrQuotaExceeded{Requested: n, Available: available(free, q.MinFreeBytes)}
+		}
+	}
+	return nil
+}
+
+// available returns how much of limit is left after used, or zero.
+func available(limit, used uint64) uint64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
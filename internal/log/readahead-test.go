@@ -0,0 +1,60 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestReadAhead(t *testing.T) {
+	dir, err := os.MkdirTemp("", "readahead-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 10
+	c.ReadAhead.Bytes = 64
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	appendRecords(t, l, 25)
+
+	// A stream is prefetched for once it's made enough sequential reads
+	rec := &api.Record{}
+	for offset := uint64(0); offset < sequentialReads; offset++ {
+		require.NoError(t, l.ReadInto(offset, rec))
+	}
+	st := l.segments[0].reads.streams[sequentialReads]
+	require.NotNil(t, st)
+	require.Equal(t, sequentialReads, st.run)
+	_, pos, err := l.segments[0].index.Read(sequentialReads - 1)
+	require.NoError(t, err)
+	require.Equal(t, pos+c.ReadAhead.Bytes, st.until)
+
+	// and follows it into the next segment, but not up to the end of one
+	for offset := uint64(sequentialReads); offset < 12; offset++ {
+		_, err := l.Read(offset)
+		require.NoError(t, err)
+	}
+	require.Empty(t, l.segments[0].reads.streams)
+	st = l.segments[1].reads.streams[12]
+	require.NotNil(t, st)
+	require.Equal(t, 12, st.run)
+	for _, s := range l.segments[:len(l.segments)-1] {
+		for _, st := range s.reads.streams {
+			require.LessOrEqual(t, st.until, s.Size())
+		}
+	}
+
+	// Random reads each start a stream of their own, up to a limit
+	for i := 0; i < maxReadStreams*2; i++ {
+		_, err := l.Read(uint64(i*7) % 20)
+		require.NoError(t, err)
+	}
+	for _, s := range l.segments {
+		require.LessOrEqual(t, len(s.reads.streams), maxReadStreams)
+	}
+}
@@ -0,0 +1,157 @@
+package log
+
+import (
+	"context"
+	"sync"
+
+	"go.opencensus.io/stats"
+)
+
+const (
+	// sequentialReads is how many reads in a row a stream makes before its
+	// upcoming records are prefetched.
+	sequentialReads = 4
+	// maxReadStreams bounds how many streams are tracked at once in each
+	// segment.
+	maxReadStreams = 64
+)
+
+// readAhead detects streams of sequential reads and prefetches the store bytes
+// they're about to read, so that consumers catching up on old records don't
+// wait on one small read per record. Reads aren't tagged with the stream they
+// belong to, so like the kernel's read-ahead a stream is recognised by a read
+// of the offset after the one it last read. Streams are tracked in the segment
+// they're reading, so readers of different segments don't contend.
+type readAhead struct {
+	window uint64
+}
+
+// readStreams are the streams reading a segment.
+type readStreams struct {
+	mu sync.Mutex
+	// streams is keyed by the offset each stream is expected to read next
+	streams map[uint64]*readStream
+	clock   uint64
+}
+
+type readStream struct {
+	run      int
+	lastUsed uint64
+	// until is the store position the segment is prefetched up to for the
+	// stream.
+	until uint64
+}
+
+// newReadAhead returns nil when window is 0, which disables read-ahead since
+// every method is a no-op on a nil readAhead.
+func newReadAhead(window uint64) *readAhead {
+	if window == 0 {
+		return nil
+	}
+	return &readAhead{window: window}
+}
+
+// Read notes a read of offset from s, which the caller must have acquired,
+// and prefetches the window after it once the read continues a sequential
+// stream. prev is the segment before s when offset is s's first, so that a
+// stream carries on into s. Prefetching is best effort, so errors are ignored.
+func (r *readAhead) Read(ctx context.Context, prev, s *segment, offset uint64) {
+	if r == nil {
+		return
+	}
+	var st *readStream
+	if prev != nil {
+		if st = prev.reads.take(offset); st != nil {
+			// The prefetched window was in prev's store
+			st.until = 0
+		}
+	}
+	s.reads.mu.Lock()
+	defer s.reads.mu.Unlock()
+	st = s.reads.stream(offset, st)
+	st.run++
+	if st.run < sequentialReads {
+		return
+	}
+	_, pos, err := s.index.Read(int64(offset - s.baseOffset))
+	if err != nil {
+		return
+	}
+	covered := pos < st.until
+	if st.run > sequentialReads {
+		if covered {
+			stats.Record(ctx, readAheadHits.M(1))
+		} else {
+			stats.Record(ctx, readAheadMisses.M(1))
+		}
+	}
+	// Top the window up once the stream is half way through it
+	if covered && st.until-pos > r.window/2 {
+		return
+	}
+	from := pos
+	if covered {
+		from = st.until
+	}
+	until := pos + r.window
+	if until > s.store.size {
+		until = s.store.size
+	}
+	if from >= until {
+		return
+	}
+	if err = fadvise(s.store.File, int64(from), int64(until-from)); err != nil {
+		return
+	}
+	st.until = until
+	stats.Record(ctx, readAheadBytes.M(int64(until-from)))
+}
+
+// take removes and returns the stream whose next read is offset, if any.
+func (r *readStreams) take(offset uint64) *readStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, ok := r.streams[offset]
+	if !ok {
+		return nil
+	}
+	delete(r.streams, offset)
+	return st
+}
+
+// stream returns the stream whose next read is offset, carrying on with from
+// if it's not nil or else starting a new one, and moves it on to the
+// following offset. The caller must hold r.mu.
+func (r *readStreams) stream(offset uint64, from *readStream) *readStream {
+	if r.streams == nil {
+		r.streams = make(map[uint64]*readStream)
+	}
+	r.clock++
+	st, ok := r.streams[offset]
+	if ok {
+		delete(r.streams, offset)
+	} else {
+		if len(r.streams) >= maxReadStreams {
+			r.evict()
+		}
+		st = from
+		if st == nil {
+			st = &readStream{}
+		}
+	}
+	st.lastUsed = r.clock
+	r.streams[offset+1] = st
+	return st
+}
+
+// evict forgets the least recently used stream. The caller must hold r.mu.
+func (r *readStreams) evict() {
+	var oldest uint64
+	var st *readStream
+	for offset, s := range r.streams {
+		if st == nil || s.lastUsed < st.lastUsed {
+			oldest, st = offset, s
+		}
+	}
+	delete(r.streams, oldest)
+}
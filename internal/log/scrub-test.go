@@ -0,0 +1,48 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestLogScrub(t *testing.T) {
+	dir, err := os.MkdirTemp("", "scrub-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, l, 7)
+	require.Equal(t, 3, len(l.segments))
+
+	// Flip a byte in the middle record of the second segment
+	s := l.segments[1]
+	require.NoError(t, l.acquire(s))
+	_, pos, err := s.index.Read(1)
+	require.NoError(t, err)
+	l.release(s)
+	f, err := os.OpenFile(s.path(".store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(pos+lenWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Each scrub verifies one sealed segment, wrapping around
+	require.NoError(t, l.scrub())
+	require.Empty(t, l.CorruptRanges())
+	require.NoError(t, l.scrub())
+	require.Equal(t, []*api.OffsetRange{{First: 4, Last: 4}}, l.CorruptRanges())
+	require.NoError(t, l.scrub())
+	require.Equal(t, l.segments[0].nextOffset, l.scrubNext)
+	require.Equal(t, 1, len(l.CorruptRanges()))
+
+	// Ranges go away with their segment
+	require.NoError(t, l.Truncate(5))
+	require.Empty(t, l.CorruptRanges())
+}
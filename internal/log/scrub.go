@@ -0,0 +1,87 @@
+package log
+
+import (
+	"go.opencensus.io/stats"
+	"go.uber.org/zap"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// scrub verifies the sealed segment after the last one scrubbed, wrapping
+// around to the oldest once it reaches the active segment. Only one segment is
+// verified per call and the log's lock isn't held while reading it, so
+// scrubbing stays out of the way of appends and reads.
+func (l *Log) scrub() error {
+	l.mu.RLock()
+	s := l.nextScrub()
+	if s == nil {
+		l.mu.RUnlock()
+		return nil
+	}
+	err := l.acquire(s)
+	l.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	ranges := s.Verify()
+	l.release(s)
+
+	var n int64
+	for _, r := range ranges {
+		n += int64(r.Last - r.First + 1)
+		zap.L().Named("log").Error(
+			"corrupt records found",
+			zap.String("dir", s.dir),
+			zap.Uint64("first", r.First),
+			zap.Uint64("last", r.Last),
+		)
+	}
+	stats.Record(l.ctx, scrubbedSegments.M(1), corruptRecords.M(n))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Forget segments that were truncated or merged away since the scrub
+	// started
+	corrupt := make(map[*segment][]*api.OffsetRange)
+	for _, seg := range l.segments {
+		if r, ok := l.corrupt[seg]; ok {
+			corrupt[seg] = r
+		}
+	}
+	if ranges == nil {
+		delete(corrupt, s)
+	} else {
+		corrupt[s] = ranges
+	}
+	l.corrupt = corrupt
+	l.scrubNext = s.nextOffset
+	return nil
+}
+
+// nextScrub returns the first sealed segment at or after scrubNext in an
+// online directory, starting over from the oldest if there isn't one. The
+// caller must hold l.mu.
+func (l *Log) nextScrub() *segment {
+	for _, from := range []uint64{l.scrubNext, 0} {
+		for _, s := range l.segments {
+			if s.sealed && s.baseOffset >= from && l.online(s.dir) {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// CorruptRanges returns the ranges of offsets the scrubber found corrupt in the
+// sealed segments still in the log.
+func (l *Log) CorruptRanges() []*api.OffsetRange {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var ranges []*api.OffsetRange
+	for _, s := range l.segments {
+		if s.sealed {
+			ranges = append(ranges, l.corrupt[s]...)
+		}
+	}
+	return ranges
+}
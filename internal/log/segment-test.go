@@ -26,7 +26,7 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 
 	for i := uint64(0); i < 3; i++ {
-		offset, err := s.Append(expected)
+		offset, err := s.Append(expected, 0)
 		require.NoError(t, err)
 		require.Equal(t, 16+i, offset)
 
@@ -35,7 +35,7 @@ func TestSegment(t *testing.T) {
 		require.Equal(t, expected.Value, res.Value)
 	}
 
-	_, err = s.Append(expected)
+	_, err = s.Append(expected, 0)
 	require.Equal(t, io.EOF, err)
 	require.True(t, s.IsMaxed())
 
@@ -1,75 +1,202 @@
 package log
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"sync"
+	"time"
 
-	"google.golang.org.protobuf/proto"
+	"google.golang.org/protobuf/proto"
 
 	api "github.com/alphaleph/yojimbo/api/v1"
 )
 
 type segment struct {
+	// mu guards store and index being opened and closed. Readers hold it
+	// shared between acquire and release so a segment can't be closed under
+	// them.
+	mu                     sync.RWMutex
+	dir                    string
 	store                  *store
 	index                  *index
+	keys                   *keyIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+	// sealed is set once the log has rolled past the segment, after which
+	// it's never appended to again.
+	sealed bool
+	// size is a sealed segment's store size, known without opening it.
+	size      uint64
+	createdAt time.Time
+	// removed is set once the segment's files are gone, so it's never
+	// reopened through a stale reference.
+	removed bool
+	// reads are the sequential streams reading the segment, for read-ahead.
+	reads readStreams
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
+		dir:        dir,
 		baseOffset: baseOffset,
 		config:     c,
+		createdAt:  time.Now(),
 	}
-	var err error
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	// Check if index is empty and init nextOffset accordingly
+	if offset, _, err := s.index.Read(-1); err != nil {
+		s.nextOffset = baseOffset
+	} else {
+		s.nextOffset = baseOffset + uint64(offset) + 1
+	}
+	return s, nil
+}
+
+// newSealedSegment returns a closed segment for a sealed segment's files. Its
+// offsets are known from its neighbours so nothing is opened until it's first
+// read.
+func newSealedSegment(dir string, baseOffset, nextOffset, size uint64, c Config) *segment {
+	return &segment{
+		dir:        dir,
+		baseOffset: baseOffset,
+		nextOffset: nextOffset,
+		config:     c,
+		sealed:     true,
+		size:       size,
+	}
+}
+
+func (s *segment) open() error {
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		s.path(".store"),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
-		return nil, err
+	store, err := newStore(storeFile)
+	if err != nil {
+		storeFile.Close()
+		return err
 	}
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		s.path(".index"),
 		os.O_RDWR|os.O_CREATE,
 		0644,
 	)
 	if err != nil {
-		return nil, err
+		store.Close()
+		return err
 	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
-		return nil, err
+	index, err := newIndex(indexFile, s.config)
+	if err != nil {
+		indexFile.Close()
+		store.Close()
+		return err
 	}
-	// Check if index is empty and init nextOffset accordingly
-	if offset, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = baseOffset
-	} else {
-		s.nextOffset = baseOffset + uint64(offset) + 1
+	keysFile, err := os.OpenFile(
+		s.path(".keys"),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		index.Close()
+		store.Close()
+		return err
 	}
-	return s, nil
+	keys, err := newKeyIndex(keysFile)
+	if err != nil {
+		keysFile.Close()
+		index.Close()
+		store.Close()
+		return err
+	}
+	if s.sealed {
+		// The index file may not have been truncated to its entries if we
+		// crashed while it was open, but a sealed segment's size is known
+		if err = index.Reset(s.nextOffset - s.baseOffset); err != nil {
+			keys.Close()
+			indexFile.Close()
+			store.Close()
+			return err
+		}
+		if s.config.Segment.MmapSealed {
+			if err = store.Map(); err != nil {
+				keys.Close()
+				index.Close()
+				store.Close()
+				return err
+			}
+		}
+	}
+	s.store, s.index, s.keys = store, index, keys
+	return nil
+}
 
+func (s *segment) path(ext string) string {
+	return path.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, ext))
+}
+
+// acquire opens the segment if it's closed and keeps it open until release.
+func (s *segment) acquire() error {
+	for {
+		s.mu.RLock()
+		if s.store != nil {
+			return nil
+		}
+		s.mu.RUnlock()
+		s.mu.Lock()
+		if s.removed {
+			s.mu.Unlock()
+			return os.ErrNotExist
+		}
+		if s.store == nil {
+			if err := s.open(); err != nil {
+				s.mu.Unlock()
+				return err
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *segment) release() {
+	s.mu.RUnlock()
 }
 
 func (s *segment) Read(offset uint64) (*api.Record, error) {
+	rec := &api.Record{}
+	if err := s.ReadInto(offset, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// ReadInto decodes the record at offset into rec, reading the store through a
+// pooled buffer.
+func (s *segment) ReadInto(offset uint64, rec *api.Record) error {
 	_, pos, err := s.index.Read(int64(offset - s.baseOffset)) // Recall: Index entry offsets are relative to their base offset, so we subtract accordingly
 	if err != nil {
-		return nil, err
+		return err
 	}
-	p, err := s.store.Read(pos)
+	bp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bp)
+	p, err := s.store.ReadInto(pos, (*bp)[:0])
 	if err != nil {
-		return nil, err
+		return err
 	}
-	rec := &api.Record{}
-	err = proto.Unmarshal(p, rec)
-	return rec, err
+	*bp = p[:0]
+	return proto.Unmarshal(p, rec)
 }
 
-func (s *segment) Append(rec *api.Record) (offset uint64, err error) {
+// Append writes rec at the next offset. prev is the offset of the record
+// before it with the same key, which the key index keeps with its entry.
+func (s *segment) Append(rec *api.Record, prev uint64) (offset uint64, err error) {
 	cur := s.nextOffset
 	rec.Offset = cur
 	p, err := proto.Marshal(rec)
@@ -87,32 +214,287 @@ func (s *segment) Append(rec *api.Record) (offset uint64, err error) {
 		return 0, err
 	}
 	s.nextOffset++
+	if rec.Key != "" {
+		e := keyEntry{Key: rec.Key, Version: rec.Version, Offset: cur, Prev: prev}
+		if err = s.keys.Write(e); err != nil {
+			return 0, err
+		}
+	}
 	return cur, nil
 }
 
+// keysAfter returns the key index entries for the records after offset,
+// opening the segment if needed.
+func (s *segment) keysAfter(offset uint64) ([]keyEntry, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.keys.From(offset + 1), nil
+}
+
+// TruncateAfter drops every record after offset. The index is cut before the
+// store so that a crash in between never leaves entries pointing past the end
+// of the store.
+func (s *segment) TruncateAfter(offset uint64) error {
+	if offset+1 >= s.nextOffset {
+		return nil
+	}
+	rel := offset + 1 - s.baseOffset
+	_, pos, err := s.index.Read(int64(rel))
+	if err != nil {
+		return err
+	}
+	if err = s.index.Truncate(rel); err != nil {
+		return err
+	}
+	if err = s.store.Truncate(pos); err != nil {
+		return err
+	}
+	if _, err = s.keys.TruncateFrom(offset + 1); err != nil {
+		return err
+	}
+	s.nextOffset = offset + 1
+	return nil
+}
+
+// Seal syncs the segment to disk once the log has rolled past it.
+func (s *segment) Seal() error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	if s.config.Segment.MmapSealed {
+		if err := s.store.Map(); err != nil {
+			return err
+		}
+	}
+	s.sealed = true
+	s.size = s.store.size
+	return nil
+}
+
+// Abandon seals the segment without syncing it because its directory went
+// offline.
+func (s *segment) Abandon() error {
+	s.sealed = true
+	s.size = s.store.size
+	return s.Close()
+}
+
+// Unseal makes a sealed segment appendable again, when truncating the log
+// back into it.
+func (s *segment) Unseal() error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	s.release()
+	// Wait out readers that don't hold the log's lock, like the scrubber,
+	// before the mapping goes away
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.store.Unmap(); err != nil {
+		return err
+	}
+	s.sealed = false
+	return nil
+}
+
+// Size returns the size of the segment's store.
+func (s *segment) Size() uint64 {
+	if s.sealed {
+		return s.size
+	}
+	return s.store.size
+}
+
+// Sync commits the store and then the indexes to disk, so a synced index entry
+// never points at store bytes that didn't make it.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.keys.Sync()
+}
+
+// Recover rebuilds the active segment's indexes after an unclean shutdown.
+// Everything before nextOffset and pos was known to be consistent, so only
+// the records written after it are read back from the store. The first torn
+// or undecodable record and everything after it is dropped. It returns the
+// key index entries of the records that were dropped. findPrev finds the
+// offset of a key's earlier version in the segments before this one, for the
+// records indexed again whose previous version isn't in the segment.
+func (s *segment) Recover(nextOffset, pos uint64, findPrev func(key string, version uint64) (uint64, error)) ([]keyEntry, error) {
+	if nextOffset < s.baseOffset || pos > s.store.size {
+		nextOffset, pos = s.baseOffset, 0
+	}
+	if err := s.index.Reset(nextOffset - s.baseOffset); err != nil {
+		return nil, err
+	}
+	// Entries past nextOffset are written again for the records that
+	// survive
+	dropped, err := s.keys.TruncateFrom(nextOffset)
+	if err != nil {
+		return nil, err
+	}
+	rec := &api.Record{}
+	var size [lenWidth]byte
+	for pos+lenWidth <= s.store.size {
+		if _, err := s.store.ReadAt(size[:], int64(pos)); err != nil {
+			break
+		}
+		if enc.Uint64(size[:]) > s.store.size-pos-lenWidth {
+			break
+		}
+		p, err := s.store.Read(pos)
+		if err != nil {
+			break
+		}
+		if err = proto.Unmarshal(p, rec); err != nil || rec.Offset != nextOffset {
+			break
+		}
+		if err = s.index.Write(uint32(nextOffset-s.baseOffset), pos); err != nil {
+			break
+		}
+		if rec.Key != "" {
+			e := keyEntry{Key: rec.Key, Version: rec.Version, Offset: nextOffset}
+			if e.Version > 0 {
+				if last, ok := s.keys.Last(rec.Key); ok && last.Version+1 == e.Version {
+					e.Prev = last.Offset
+				} else if e.Prev, err = findPrev(rec.Key, e.Version-1); err != nil {
+					return nil, err
+				}
+			}
+			if err = s.keys.Write(e); err != nil {
+				return nil, err
+			}
+		}
+		pos += lenWidth + uint64(len(p))
+		nextOffset++
+	}
+	s.nextOffset = nextOffset
+	if pos < s.store.size {
+		if err := s.store.Truncate(pos); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.index.Sync(); err != nil {
+		return nil, err
+	}
+	if err := s.keys.Sync(); err != nil {
+		return nil, err
+	}
+	var lost []keyEntry
+	for _, e := range dropped {
+		if e.Offset >= nextOffset {
+			lost = append(lost, e)
+		}
+	}
+	return lost, nil
+}
+
+// Verify re-reads every record in the segment and returns the ranges of
+// offsets whose index entry, framing or encoding is corrupt. The caller must
+// have acquired the segment.
+func (s *segment) Verify() []*api.OffsetRange {
+	var ranges []*api.OffsetRange
+	corrupt := func(offset uint64) {
+		if n := len(ranges); n > 0 && ranges[n-1].Last+1 == offset {
+			ranges[n-1].Last = offset
+			return
+		}
+		ranges = append(ranges, &api.OffsetRange{First: offset, Last: offset})
+	}
+	rec := &api.Record{}
+	var size [lenWidth]byte
+	var p []byte
+	for offset := s.baseOffset; offset < s.nextOffset; offset++ {
+		rel, pos, err := s.index.Read(int64(offset - s.baseOffset))
+		if err != nil || uint64(rel) != offset-s.baseOffset {
+			corrupt(offset)
+			continue
+		}
+		if pos+lenWidth > s.store.size {
+			corrupt(offset)
+			continue
+		}
+		if _, err = s.store.ReadAt(size[:], int64(pos)); err != nil {
+			corrupt(offset)
+			continue
+		}
+		if enc.Uint64(size[:]) > s.store.size-pos-lenWidth {
+			corrupt(offset)
+			continue
+		}
+		p, err = s.store.ReadInto(pos, p)
+		if err != nil {
+			corrupt(offset)
+			continue
+		}
+		if err = proto.Unmarshal(p, rec); err != nil || rec.Offset != offset {
+			corrupt(offset)
+		}
+	}
+	return ranges
+}
+
+// IsExpired reports whether the segment holds records and was created more
+// than the configured max age before now.
+func (s *segment) IsExpired(now time.Time) bool {
+	return s.config.Segment.MaxAge != 0 &&
+		s.nextOffset > s.baseOffset &&
+		now.Sub(s.createdAt) >= s.config.Segment.MaxAge
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
 }
 
 func (s *segment) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store == nil {
+		return nil
+	}
+	if err := s.keys.Close(); err != nil {
+		return err
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+	s.keys, s.index, s.store = nil, nil, nil
 	return nil
+}
 
+// Discard closes the segment for good without removing its files, e.g. because
+// they were replaced by a merged segment's.
+func (s *segment) Discard() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.removed = true
+	s.mu.Unlock()
+	return nil
 }
 
 func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+	if err := s.Discard(); err != nil {
+		return err
+	}
+	// Segments written before keys were indexed have no key index
+	if err := os.Remove(s.path(".keys")); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := os.Remove(s.path(".index")); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := os.Remove(s.path(".store")); err != nil {
 		return err
 	}
 	return nil
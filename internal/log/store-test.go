@@ -1,6 +1,7 @@
 package log
 
 import (
+	"io"
 	"os"
 	"testing"
 
@@ -50,6 +51,40 @@ func TestStoreAppendRead(t *testing.T) {
 	testRead(t, s)
 }
 
+func TestStoreMap(t *testing.T) {
+	f, err := os.CreateTemp("", "store-map-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	// An empty store isn't mapped
+	require.NoError(t, s.Map())
+	require.Nil(t, s.mmap)
+
+	testAppend(t, s)
+	require.NoError(t, s.Map())
+	require.NotNil(t, s.mmap)
+	testRead(t, s)
+	testReadAt(t, s)
+	_, err = s.Read(width * 3)
+	require.Error(t, err)
+	n, err := s.ReadAt(make([]byte, lenWidth+1), int64(width*3-lenWidth))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int(lenWidth), n)
+
+	// Unmapped, the store can be appended to again
+	require.NoError(t, s.Unmap())
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, width*3, pos)
+	require.NoError(t, s.Map())
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.NoError(t, s.Close())
+}
+
 func testRead(t *testing.T, s *store) {
 	t.Helper()
 	var pos uint64
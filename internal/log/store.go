@@ -3,8 +3,11 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"io"
 	"os"
 	"sync"
+
+	"github.com/tysontate/gommap"
 )
 
 var (
@@ -17,9 +20,22 @@ const (
 
 type store struct {
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	mu     sync.Mutex
+	buf    *bufio.Writer
+	size   uint64
+	lenBuf [lenWidth]byte
+	// mmap maps a sealed store's file for reading without taking mu. It's
+	// only set or cleared while nothing else is using the store.
+	mmap gommap.MMap
+}
+
+// bufPool holds scratch buffers for decoding records so the read path doesn't
+// allocate a payload slice per record.
+var bufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -52,23 +68,45 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 }
 
 func (s *store) Read(pos uint64) ([]byte, error) {
+	return s.ReadInto(pos, nil)
+}
+
+// ReadInto reads the record at pos into p, growing it if it's too small, and
+// returns the slice holding the record.
+func (s *store) ReadInto(pos uint64, p []byte) ([]byte, error) {
+	if s.mmap != nil {
+		return s.readMapped(pos, p)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
 		return nil, err
 	}
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	if _, err := s.File.ReadAt(s.lenBuf[:], int64(pos)); err != nil {
 		return nil, err
 	}
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	size := enc.Uint64(s.lenBuf[:])
+	if uint64(cap(p)) < size {
+		p = make([]byte, size)
+	}
+	p = p[:size]
+	if _, err := s.File.ReadAt(p, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
-	return b, nil
+	return p, nil
 }
 
 func (s *store) ReadAt(p []byte, offset int64) (int, error) {
+	if s.mmap != nil {
+		if offset >= int64(len(s.mmap)) {
+			return 0, io.EOF
+		}
+		n := copy(p, s.mmap[offset:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
@@ -77,7 +115,86 @@ func (s *store) ReadAt(p []byte, offset int64) (int, error) {
 	return s.File.ReadAt(p, offset)
 }
 
+// readMapped is ReadInto for a mapped store.
+func (s *store) readMapped(pos uint64, p []byte) ([]byte, error) {
+	if pos+lenWidth > uint64(len(s.mmap)) {
+		return nil, io.EOF
+	}
+	size := enc.Uint64(s.mmap[pos : pos+lenWidth])
+	if size > uint64(len(s.mmap))-pos-lenWidth {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if uint64(cap(p)) < size {
+		p = make([]byte, size)
+	}
+	p = p[:size]
+	copy(p, s.mmap[pos+lenWidth:])
+	return p, nil
+}
+
+// Map maps the store's file so that reads don't contend on mu. The store must
+// not be written to while it's mapped.
+func (s *store) Map() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if s.mmap != nil || s.size == 0 {
+		return nil
+	}
+	m, err := gommap.Map(s.File.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.mmap = m
+	return nil
+}
+
+// Unmap goes back to reading through the file so the store can be written to.
+func (s *store) Unmap() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mmap == nil {
+		return nil
+	}
+	if err := s.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	s.mmap = nil
+	return nil
+}
+
+// Sync flushes buffered writes and commits the file to disk.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if err := s.File.Sync(); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
 func (s *store) Close() error {
+	if err := s.Unmap(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	err := s.buf.Flush()
@@ -0,0 +1,241 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestStreams(t *testing.T) {
+	s := newStreams()
+	for offset := uint64(0); offset < 6; offset++ {
+		key := "a"
+		if offset%3 == 2 {
+			key = "b"
+		}
+		s.Appended(&api.Record{Key: key, Offset: offset, Version: s.Next(key)})
+	}
+	s.Appended(&api.Record{Offset: 6})
+	require.Equal(t, uint64(4), s.Next("a"))
+	require.Equal(t, uint64(2), s.Next("b"))
+	require.Equal(t, uint64(0), s.Next("c"))
+	require.Equal(t, uint64(4), s.Last("a"))
+	require.Equal(t, uint64(5), s.Last("b"))
+
+	// Removing records from the end hands their versions out again
+	s.Removed([]keyEntry{{Key: "b", Version: 1, Offset: 5, Prev: 2}})
+	require.Equal(t, uint64(1), s.Next("b"))
+	require.Equal(t, uint64(2), s.Last("b"))
+	require.Equal(t, uint64(4), s.Next("a"))
+}
+
+func TestStreamsSave(t *testing.T) {
+	dir, err := os.MkdirTemp("", "streams-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, found, err := openStreams(dir)
+	require.NoError(t, err)
+	require.False(t, found)
+	for i := 0; i < 100; i++ {
+		s.Appended(&api.Record{Key: fmt.Sprint(i), Offset: uint64(i)})
+	}
+	require.NoError(t, s.Save())
+	require.Equal(t, 100, s.written)
+
+	// Only the streams that changed are appended
+	s.Appended(&api.Record{Key: "7", Version: 1, Offset: 100})
+	require.NoError(t, s.Save())
+	require.Equal(t, 101, s.written)
+	require.NoError(t, s.Save())
+	require.Equal(t, 101, s.written)
+	require.NoError(t, s.Close())
+
+	// A torn entry at the end of the file is dropped
+	f, err := os.OpenFile(path.Join(dir, streamsFile), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 1, '7', 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	s, found, err = openStreams(dir)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, 100, len(s.keys))
+	require.Equal(t, stream{Next: 2, Last: 100}, s.keys["7"])
+	require.Equal(t, stream{Next: 1, Last: 8}, s.keys["8"])
+
+	// The file is rewritten once most of it is stale
+	for i := uint64(0); i < 200; i++ {
+		s.Appended(&api.Record{Key: "7", Version: i + 2, Offset: 101 + i})
+		require.NoError(t, s.Save())
+	}
+	require.LessOrEqual(t, s.written, 2*len(s.keys)+64)
+	require.NoError(t, s.Close())
+	s, _, err = openStreams(dir)
+	require.NoError(t, err)
+	require.Equal(t, 100, len(s.keys))
+	require.Equal(t, stream{Next: 202, Last: 300}, s.keys["7"])
+	require.NoError(t, s.Close())
+}
+
+func TestLogStreams(t *testing.T) {
+	dir, err := os.MkdirTemp("", "streams-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		_, err = l.Append(&api.Record{Key: "a"})
+		require.NoError(t, err)
+	}
+	offsets, err := l.StreamOffsets("a", 2)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3, 4, 5, 6}, offsets)
+	require.NoError(t, l.Truncate(2))
+	require.NoError(t, l.Close())
+
+	// The streams file only holds where the stream ends and the versions
+	// of the truncated records aren't reused
+	s, _, err := openStreams(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string]stream{"a": {Next: 7, Last: 6}}, s.keys)
+	require.NoError(t, s.Close())
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	offsets, err = l.StreamOffsets("a", 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4, 5, 6}, offsets)
+	rec := &api.Record{Key: "a"}
+	_, err = l.AppendVersion(7, rec)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), rec.Version)
+
+	// Truncating the tail hands the removed versions out again
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	_, err = l.AppendVersion(8, &api.Record{Key: "a"})
+	require.NoError(t, err)
+	require.NoError(t, l.TruncateAfter(highest))
+	rec = &api.Record{Key: "a", Value: []byte("again")}
+	_, err = l.AppendVersion(8, rec)
+	require.NoError(t, err)
+	offsets, err = l.StreamOffsets("a", 8)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{rec.Offset}, offsets)
+
+	// Truncating every record of a stream keeps its version
+	require.NoError(t, l.Truncate(rec.Offset))
+	offsets, err = l.StreamOffsets("a", 0)
+	require.NoError(t, err)
+	require.Empty(t, offsets)
+	_, err = l.AppendVersion(0, &api.Record{Key: "a"})
+	require.Equal(t, api.ErrUnexpectedVersion{Key: "a", Expected: 0, Actual: 9}, err)
+	require.NoError(t, l.Close())
+}
+
+func TestLogStreamsRecover(t *testing.T) {
+	dir, err := os.MkdirTemp("", "streams-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(&api.Record{Key: "a"})
+		require.NoError(t, err)
+	}
+	l.mu.RLock()
+	require.NoError(t, l.checkpoint(false))
+	l.mu.RUnlock()
+	for i := 0; i < 2; i++ {
+		_, err = l.Append(&api.Record{Key: "a"})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.activeSegment.store.Sync())
+
+	// Crash without syncing the key index. The records written after the
+	// checkpoint are indexed again when they're recovered.
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	offsets, err := l.StreamOffsets("a", 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, offsets)
+	_, err = l.AppendVersion(5, &api.Record{Key: "a"})
+	require.NoError(t, err)
+
+	// Records indexed again point back at the stream's records in the
+	// sealed segments
+	require.NoError(t, l.Close())
+	c.Segment.MaxIndexBytes = entryWidth * 8
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = l.Append(&api.Record{Key: "a"})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, len(l.segments))
+	require.NoError(t, l.activeSegment.store.Sync())
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	offsets, err = l.StreamOffsets("a", 6)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{6, 7, 8, 9}, offsets)
+	require.NoError(t, l.Close())
+}
+
+func TestLogStreamOffsetsOpenedSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "streams-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	// Version 0 of "a" is in the first segment and the rest in the last
+	// sealed one
+	for offset := 0; offset < 30; offset++ {
+		key := "b"
+		if offset == 0 || offset == 27 || offset == 29 {
+			key = "a"
+		}
+		_, err = l.Append(&api.Record{Key: key})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	opened := func() int {
+		var n int
+		for _, s := range l.segments[:len(l.segments)-1] {
+			if s.store != nil {
+				n++
+			}
+		}
+		return n
+	}
+	require.Equal(t, 10, len(l.segments)-1)
+	require.Equal(t, 0, opened())
+
+	// Only the segments holding the versions asked for are opened
+	offsets, err := l.StreamOffsets("a", 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{27, 29}, offsets)
+	require.Equal(t, 1, opened())
+	offsets, err = l.StreamOffsets("a", 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 27, 29}, offsets)
+	require.Equal(t, 2, opened())
+}
@@ -0,0 +1,302 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// ErrNoKey is returned when appending at an expected version a record that
+// has no key, and so belongs to no stream.
+var ErrNoKey = errors.New("record has no key")
+
+const streamsFile = "streams"
+
+// streamEntryWidth is the width of an entry in the streams file besides its
+// key.
+const streamEntryWidth = keyLenWidth + 8 + 8
+
+// stream is how far a key's stream has got.
+type stream struct {
+	// Next is the version the key's next record gets.
+	Next uint64
+	// Last is the offset of the key's latest record. It's only meaningful
+	// while Next is above zero.
+	Last uint64
+}
+
+// streams tracks the version each key's next record gets. Each key's records
+// form a stream and are versioned from 0 in the order they're appended. The
+// offsets of a key's records are indexed in the key index of the segments
+// holding them, each entry pointing at the record before it, so only where
+// each stream ends is kept in memory.
+//
+// Log keeps them in a streams file beside its checkpoint. Only the streams
+// that changed since the last checkpoint are appended to it, and it's
+// rewritten once most of its entries are stale, so checkpointing doesn't
+// write every key. MemoryLog has no file.
+type streams struct {
+	keys map[string]stream
+	// dirty holds the keys whose streams changed since they were last
+	// saved. It's nil if there's no file to save them to.
+	dirty map[string]struct{}
+	dir   string
+	file  *os.File
+	// written counts the entries in the file, and stale is set when they
+	// no longer hold the streams, e.g. because they were reset.
+	written int
+	stale   bool
+}
+
+func newStreams() *streams {
+	return &streams{keys: make(map[string]stream)}
+}
+
+// openStreams loads the streams saved in dir and reports whether it had a
+// streams file. A torn entry a crash left at the end of the file is dropped.
+func openStreams(dir string) (*streams, bool, error) {
+	s := newStreams()
+	s.dir, s.dirty = dir, make(map[string]struct{})
+	name := path.Join(dir, streamsFile)
+	b, err := os.ReadFile(name)
+	found := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+	var pos uint64
+	for pos+streamEntryWidth <= uint64(len(b)) {
+		n := uint64(enc.Uint32(b[pos:]))
+		if pos+streamEntryWidth+n > uint64(len(b)) {
+			break
+		}
+		key := pos + keyLenWidth
+		s.keys[string(b[key:key+n])] = stream{
+			Next: enc.Uint64(b[key+n:]),
+			Last: enc.Uint64(b[key+n+8:]),
+		}
+		s.written++
+		pos += streamEntryWidth + n
+	}
+	s.file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	if pos < uint64(len(b)) {
+		if err = s.file.Truncate(int64(pos)); err != nil {
+			s.file.Close()
+			return nil, false, err
+		}
+	}
+	return s, found, nil
+}
+
+// Next returns the version the key's next record gets. Versions aren't reused
+// once the key's records are truncated.
+func (s *streams) Next(key string) uint64 {
+	return s.keys[key].Next
+}
+
+// Last returns the offset of the key's latest record, if Next is above zero.
+func (s *streams) Last(key string) uint64 {
+	return s.keys[key].Last
+}
+
+// Appended notes rec, which was appended with its version set.
+func (s *streams) Appended(rec *api.Record) {
+	if rec.Key == "" {
+		return
+	}
+	s.set(rec.Key, stream{Next: rec.Version + 1, Last: rec.Offset})
+}
+
+// Removed notes that the records of entries were removed from the end of the
+// log, so their versions are handed out again.
+func (s *streams) Removed(entries []keyEntry) {
+	for _, e := range entries {
+		if st, ok := s.keys[e.Key]; ok && e.Version < st.Next {
+			s.set(e.Key, stream{Next: e.Version, Last: e.Prev})
+		}
+	}
+}
+
+func (s *streams) set(key string, st stream) {
+	s.keys[key] = st
+	if s.dirty != nil {
+		s.dirty[key] = struct{}{}
+	}
+}
+
+// Reset forgets every stream, e.g. to rebuild them from the log's records.
+func (s *streams) Reset() {
+	s.keys = make(map[string]stream)
+	if s.dirty != nil {
+		s.dirty = make(map[string]struct{})
+	}
+	s.stale = true
+}
+
+// Save appends the streams that changed since the last save to the streams
+// file and syncs it. The file is rewritten instead if that leaves more stale
+// entries in it than there are keys.
+func (s *streams) Save() error {
+	if s.stale || s.written+len(s.dirty) > 2*len(s.keys)+64 {
+		return s.rewrite()
+	}
+	if len(s.dirty) == 0 {
+		return nil
+	}
+	var b []byte
+	for key := range s.dirty {
+		b = s.appendEntry(b, key)
+	}
+	if _, err := s.file.Write(b); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.written += len(s.dirty)
+	s.dirty = make(map[string]struct{})
+	return nil
+}
+
+// rewrite atomically replaces the streams file with one holding an entry per
+// key.
+func (s *streams) rewrite() error {
+	var b []byte
+	for key := range s.keys {
+		b = s.appendEntry(b, key)
+	}
+	name := path.Join(s.dir, streamsFile)
+	if err := writeFileSync(name+".tmp", b); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file, s.written, s.stale = f, len(s.keys), false
+	s.dirty = make(map[string]struct{})
+	return nil
+}
+
+// appendEntry appends the entry for key's stream to b.
+func (s *streams) appendEntry(b []byte, key string) []byte {
+	st := s.keys[key]
+	b = enc.AppendUint32(b, uint32(len(key)))
+	b = append(b, key...)
+	b = enc.AppendUint64(b, st.Next)
+	return enc.AppendUint64(b, st.Last)
+}
+
+func (s *streams) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// AppendVersion appends rec only if it's the next version of its key's stream,
+// returning ErrUnexpectedVersion otherwise. A retry from an idempotent producer
+// still returns the offset the record was first appended at.
+func (l *Log) AppendVersion(expected uint64, rec *api.Record) (uint64, error) {
+	if rec.Key == "" {
+		return 0, ErrNoKey
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset, dup, err := l.producers.Check(rec); err != nil || dup {
+		return offset, err
+	}
+	if next := l.streams.Next(rec.Key); next != expected {
+		return 0, api.ErrUnexpectedVersion{Key: rec.Key, Expected: expected, Actual: next}
+	}
+	return l.append(rec)
+}
+
+// StreamOffsets returns the offsets of key's records from version from
+// onwards, in order. The stream is walked back from its latest record through
+// the key indexes' pointers to each record before it, so only the segments
+// holding the versions asked for are read.
+func (l *Log) StreamOffsets(key string, from uint64) ([]uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.streams.Next(key) <= from {
+		return nil, nil
+	}
+	var offsets []uint64
+	for offset := l.streams.Last(key); ; {
+		// The stream's older records may have been truncated
+		s := l.segment(offset)
+		if s == nil {
+			break
+		}
+		entries, err := l.lookupKey(s, key)
+		if err != nil {
+			return nil, err
+		}
+		first := -1
+		for i := len(entries) - 1; i >= 0 && entries[i].Version >= from; i-- {
+			if entries[i].Offset <= offset {
+				offsets = append(offsets, entries[i].Offset)
+				first = i
+			}
+		}
+		if first < 0 {
+			break
+		}
+		e := entries[first]
+		if e.Version <= from || e.Prev == noPrev || e.Prev >= s.baseOffset {
+			break
+		}
+		offset = e.Prev
+	}
+	return reverse(offsets), nil
+}
+
+// lookupKey returns key's entries in s's key index. The caller must hold l.mu.
+func (l *Log) lookupKey(s *segment, key string) ([]keyEntry, error) {
+	if err := l.acquire(s); err != nil {
+		return nil, err
+	}
+	defer l.release(s)
+	return s.keys.Lookup(key), nil
+}
+
+// findPrev returns the offset of version of key's stream in the sealed
+// segments, or noPrev if they don't hold it. It searches them from the newest,
+// so it's only used to index records again when recovering the active
+// segment.
+func (l *Log) findPrev(key string, version uint64) (uint64, error) {
+	for i := len(l.segments) - 2; i >= 0; i-- {
+		entries, err := l.lookupKey(l.segments[i], key)
+		if err != nil {
+			return 0, err
+		}
+		for j := len(entries) - 1; j >= 0; j-- {
+			if entries[j].Version == version {
+				return entries[j].Offset, nil
+			}
+			if entries[j].Version < version {
+				return noPrev, nil
+			}
+		}
+	}
+	return noPrev, nil
+}
+
+func reverse(offsets []uint64) []uint64 {
+	for i, j := 0, len(offsets)-1; i < j; i, j = i+1, j-1 {
+		offsets[i], offsets[j] = offsets[j], offsets[i]
+	}
+	return offsets
+}
@@ -0,0 +1,54 @@
+package log
+
+import (
+	"errors"
+	"sort"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// OffsetAt returns the offset of the first record appended at or after
+// timestamp, in Unix milliseconds, or the next offset if there's none.
+func (l *Log) OffsetAt(timestamp int64) (uint64, error) {
+	l.mu.RLock()
+	lowest := l.segments[0].baseOffset
+	end := l.segments[len(l.segments)-1].nextOffset
+	l.mu.RUnlock()
+	return searchTimestamp(lowest, end, timestamp, l.Read)
+}
+
+// OffsetAt returns the offset of the first record appended at or after
+// timestamp, in Unix milliseconds, or the next offset if there's none.
+func (l *MemoryLog) OffsetAt(timestamp int64) (uint64, error) {
+	l.mu.RLock()
+	lowest := l.base
+	end := l.base + uint64(len(l.records))
+	l.mu.RUnlock()
+	return searchTimestamp(lowest, end, timestamp, l.Read)
+}
+
+// searchTimestamp binary searches the records from lowest up to end for the
+// first one appended at or after timestamp. Records truncated during the
+// search count as earlier ones. Timestamps come from the clock of the server
+// appending, so if it went back the result is approximate.
+func searchTimestamp(lowest, end uint64, timestamp int64, read func(uint64) (*api.Record, error)) (uint64, error) {
+	var err error
+	i := sort.Search(int(end-lowest), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		rec, rerr := read(lowest + uint64(i))
+		if errors.As(rerr, &api.ErrOffsetOutOfRange{}) {
+			return false
+		}
+		if rerr != nil {
+			err = rerr
+			return true
+		}
+		return rec.Timestamp >= timestamp
+	})
+	if err != nil {
+		return 0, err
+	}
+	return lowest + uint64(i), nil
+}
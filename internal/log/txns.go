@@ -0,0 +1,142 @@
+package log
+
+import (
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// txns tracks the transactions with records in a log, so that read-committed
+// readers can skip aborted records and stop short of open transactions.
+type txns struct {
+	// Open maps each open transaction to the offset of its first record.
+	Open map[uint64]uint64 `json:"open"`
+	// Closed holds the transactions that ended since the oldest record, so
+	// that truncating the log's tail can reopen them.
+	Closed map[uint64]txnRange `json:"closed"`
+}
+
+type txnRange struct {
+	// First is the offset of the transaction's first record and Last that
+	// of its marker.
+	First   uint64 `json:"first"`
+	Last    uint64 `json:"last"`
+	Aborted bool   `json:"aborted"`
+}
+
+func newTxns() *txns {
+	return &txns{
+		Open:   make(map[uint64]uint64),
+		Closed: make(map[uint64]txnRange),
+	}
+}
+
+// Appended notes that rec was appended.
+func (t *txns) Appended(rec *api.Record) {
+	if rec.TxnId == 0 {
+		return
+	}
+	first, open := t.Open[rec.TxnId]
+	switch rec.Type {
+	case api.RecordType_DATA:
+		if !open {
+			t.Open[rec.TxnId] = rec.Offset
+		}
+	case api.RecordType_COMMIT, api.RecordType_ABORT:
+		// A marker for a transaction without records here is a no-op
+		if !open {
+			return
+		}
+		delete(t.Open, rec.TxnId)
+		t.Closed[rec.TxnId] = txnRange{
+			First:   first,
+			Last:    rec.Offset,
+			Aborted: rec.Type == api.RecordType_ABORT,
+		}
+	}
+}
+
+// Stable returns the offset read-committed readers read up to: the first
+// record of the oldest open transaction, or next if there's none.
+func (t *txns) Stable(next uint64) uint64 {
+	for _, first := range t.Open {
+		if first < next {
+			next = first
+		}
+	}
+	return next
+}
+
+// Hidden reports whether rec is hidden from read-committed readers, because
+// it's a marker or it was aborted.
+func (t *txns) Hidden(rec *api.Record) bool {
+	if rec.Type != api.RecordType_DATA {
+		return true
+	}
+	if rec.TxnId == 0 {
+		return false
+	}
+	r, ok := t.Closed[rec.TxnId]
+	return ok && r.Aborted
+}
+
+// Truncate forgets the transactions that ended before lowest.
+func (t *txns) Truncate(lowest uint64) {
+	for id, r := range t.Closed {
+		if r.Last < lowest {
+			delete(t.Closed, id)
+		}
+	}
+}
+
+// TruncateAfter forgets the records after offset, reopening the transactions
+// whose markers were among them.
+func (t *txns) TruncateAfter(offset uint64) {
+	for id, first := range t.Open {
+		if first > offset {
+			delete(t.Open, id)
+		}
+	}
+	for id, r := range t.Closed {
+		if r.Last <= offset {
+			continue
+		}
+		delete(t.Closed, id)
+		if r.First <= offset {
+			t.Open[id] = r.First
+		}
+	}
+}
+
+// Clone returns a deep copy of t, e.g. to snapshot it in a checkpoint.
+func (t *txns) Clone() *txns {
+	c := &txns{
+		Open:   make(map[uint64]uint64, len(t.Open)),
+		Closed: make(map[uint64]txnRange, len(t.Closed)),
+	}
+	for id, first := range t.Open {
+		c.Open[id] = first
+	}
+	for id, r := range t.Closed {
+		c.Closed[id] = r
+	}
+	return c
+}
+
+// ReadCommitted returns the first record at or after offset that's visible to
+// read-committed readers. Transaction markers and aborted records are skipped,
+// and records from the first one of an open transaction onwards are out of
+// range until it ends.
+func (l *Log) ReadCommitted(offset uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stable := l.txns.Stable(l.activeSegment.nextOffset)
+	for o := offset; o < stable; o++ {
+		rec := &api.Record{}
+		if err := l.readInto(o, rec); err != nil {
+			return nil, err
+		}
+		if !l.txns.Hidden(rec) {
+			return rec, nil
+		}
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: offset}
+}
@@ -0,0 +1,30 @@
+package queue
+
+import (
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	keySubscription = tag.MustNewKey("yojimbo_subscription")
+	keyLog          = tag.MustNewKey("yojimbo_log")
+
+	droppedRecords = stats.Int64(
+		"yojimbo/queue/dropped_records",
+		"Number of records dropped after their last delivery for lack of a dead-letter log",
+		stats.UnitDimensionless,
+	)
+)
+
+// Views counts the records subscriptions dropped. Register them with
+// view.Register to export them alongside the server's views.
+var Views = []*view.View{
+	{
+		Name:        droppedRecords.Name(),
+		Description: droppedRecords.Description(),
+		Measure:     droppedRecords,
+		TagKeys:     []tag.Key{keySubscription, keyLog},
+		Aggregation: view.Sum(),
+	},
+}
@@ -0,0 +1,319 @@
+package queue
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+	"github.com/alphaleph/yojimbo/internal/log"
+)
+
+func TestQueues(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, jobs, dead *log.MemoryLog){
+		"consumers receive disjoint records":      testDisjoint,
+		"unacked records are redelivered":         testRedeliver,
+		"failing records are dead-lettered":       testDeadLetter,
+		"state survives reopening":                testReopen,
+		"state log is compacted":                  testCompact,
+		"subscriptions skip truncated records":    testTruncated,
+		"acking an undelivered record fails":      testAckUndelivered,
+		"subscriptions are bound to their log":    testLogMismatch,
+		"subscriptions are consumed concurrently": testConcurrent,
+		"transactional logs are read committed":   testReadCommitted,
+		"records without a dead-letter log drop":  testDrop,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "queue-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			jobs := log.NewMemoryLog(log.Config{})
+			for i := 0; i < 3; i++ {
+				_, err = jobs.Append(&api.Record{Value: []byte{byte(i)}})
+				require.NoError(t, err)
+			}
+			fn(t, dir, jobs, log.NewMemoryLog(log.Config{}))
+		})
+	}
+}
+
+func newQueues(t *testing.T, dir string, jobs, dead *log.MemoryLog) *Queues {
+	t.Helper()
+	q, err := NewQueues(dir, Config{
+		VisibilityTimeout: time.Minute,
+		MaxDeliveries:     2,
+		DeadLetter:        dead,
+		Logs: func(name string) (Log, bool) {
+			return jobs, name == "jobs" || name == "other"
+		},
+	})
+	require.NoError(t, err)
+	return q
+}
+
+func offsets(deliveries []Delivery) []uint64 {
+	var offsets []uint64
+	for _, d := range deliveries {
+		offsets = append(offsets, d.Record.Offset)
+	}
+	return offsets
+}
+
+func testDisjoint(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	defer q.Close()
+
+	first, err := q.Receive("workers", "jobs", 2)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, offsets(first))
+	require.Equal(t, uint32(1), first[0].Attempt)
+	second, err := q.Receive("workers", "jobs", 2)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2}, offsets(second))
+	third, err := q.Receive("workers", "jobs", 2)
+	require.NoError(t, err)
+	require.Empty(t, third)
+
+	// Another subscription reads the log on its own
+	other, err := q.Receive("audit", "jobs", 3)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offsets(other))
+}
+
+func testRedeliver(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	deliveries, err := q.Receive("workers", "jobs", 2)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, offsets(deliveries))
+	require.NoError(t, q.Ack("workers", "jobs", 1))
+
+	now = now.Add(time.Minute)
+	deliveries, err = q.Receive("workers", "jobs", 2)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2}, offsets(deliveries))
+	require.Equal(t, uint32(2), deliveries[0].Attempt)
+	require.Equal(t, uint32(1), deliveries[1].Attempt)
+}
+
+func testDeadLetter(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	for attempt := uint32(1); attempt <= 2; attempt++ {
+		deliveries, err := q.Receive("workers", "jobs", 1)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{0}, offsets(deliveries))
+		require.Equal(t, attempt, deliveries[0].Attempt)
+		now = now.Add(time.Minute)
+	}
+
+	deliveries, err := q.Receive("workers", "jobs", 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, offsets(deliveries))
+	rec, err := dead.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0}, rec.Value)
+	// The dead-lettered record counts as acked
+	require.Equal(t, uint64(1), q.subs["workers"].Floor)
+}
+
+func testReopen(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	deliveries, err := q.Receive("workers", "jobs", 2)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, offsets(deliveries))
+	require.NoError(t, q.Ack("workers", "jobs", 1))
+	require.NoError(t, q.Close())
+
+	// Leases are lost, so the unacked record is due again straight away
+	q = newQueues(t, dir, jobs, dead)
+	defer q.Close()
+	deliveries, err = q.Receive("workers", "jobs", 3)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2}, offsets(deliveries))
+	require.Equal(t, uint32(2), deliveries[0].Attempt)
+}
+
+func testCompact(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	for i := 0; i < 2*compactSlack; i++ {
+		_, err := jobs.Append(&api.Record{Value: []byte("job")})
+		require.NoError(t, err)
+	}
+	for {
+		deliveries, err := q.Receive("workers", "jobs", 16)
+		require.NoError(t, err)
+		if len(deliveries) == 0 {
+			break
+		}
+		for _, d := range deliveries {
+			require.NoError(t, q.Ack("workers", "jobs", d.Record.Offset))
+		}
+	}
+	lowest, err := q.state.LowestOffset()
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+	require.LessOrEqual(t, q.events, len(q.subs)+compactSlack)
+	require.NoError(t, q.Close())
+
+	q = newQueues(t, dir, jobs, dead)
+	defer q.Close()
+	highest, err := jobs.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, highest+1, q.subs["workers"].Floor)
+	require.Empty(t, q.subs["workers"].Acked)
+}
+
+func testTruncated(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	defer q.Close()
+
+	require.NoError(t, jobs.Truncate(1))
+	deliveries, err := q.Receive("workers", "jobs", 3)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2}, offsets(deliveries))
+}
+
+func testAckUndelivered(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	defer q.Close()
+
+	require.ErrorIs(t, q.Ack("workers", "jobs", 0), ErrNotDelivered)
+	_, err := q.Receive("workers", "jobs", 1)
+	require.NoError(t, err)
+	require.ErrorIs(t, q.Ack("workers", "jobs", 1), ErrNotDelivered)
+	require.NoError(t, q.Ack("workers", "jobs", 0))
+	require.NoError(t, q.Ack("workers", "jobs", 0))
+}
+
+func testLogMismatch(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	defer q.Close()
+
+	_, err := q.Receive("workers", "jobs", 1)
+	require.NoError(t, err)
+	_, err = q.Receive("workers", "other", 1)
+	require.ErrorIs(t, err, ErrLogMismatch)
+	require.ErrorIs(t, q.Ack("workers", "other", 0), ErrLogMismatch)
+}
+
+func testConcurrent(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	for i := 0; i < compactSlack; i++ {
+		_, err := jobs.Append(&api.Record{Value: []byte("job")})
+		require.NoError(t, err)
+	}
+	highest, err := jobs.HighestOffset()
+	require.NoError(t, err)
+
+	received := map[string]map[uint64]int{"workers": {}, "audit": {}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name := range received {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				for {
+					deliveries, err := q.Receive(name, "jobs", 8)
+					require.NoError(t, err)
+					if len(deliveries) == 0 {
+						return
+					}
+					for _, d := range deliveries {
+						mu.Lock()
+						received[name][d.Record.Offset]++
+						mu.Unlock()
+						require.NoError(t, q.Ack(name, "jobs", d.Record.Offset))
+					}
+				}
+			}(name)
+		}
+	}
+	wg.Wait()
+	for name, offsets := range received {
+		require.Len(t, offsets, int(highest+1), name)
+		for offset, n := range offsets {
+			require.Equal(t, 1, n, "%s received %d", name, offset)
+		}
+	}
+	require.NoError(t, q.Close())
+
+	q = newQueues(t, dir, jobs, dead)
+	defer q.Close()
+	for name := range received {
+		require.Equal(t, highest+1, q.subs[name].Floor)
+	}
+}
+
+func testReadCommitted(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q := newQueues(t, dir, jobs, dead)
+	defer q.Close()
+
+	for _, rec := range []*api.Record{
+		{TxnId: 1},
+		{TxnId: 1, Type: api.RecordType_ABORT},
+		{TxnId: 2},
+		{TxnId: 2, Type: api.RecordType_COMMIT},
+		{},
+		{TxnId: 3},
+		{},
+	} {
+		_, err := jobs.Append(rec)
+		require.NoError(t, err)
+	}
+	deliveries, err := q.Receive("workers", "jobs", 10)
+	require.NoError(t, err)
+	// Aborted records and markers are skipped and the open transaction
+	// holds back the records after it
+	require.Equal(t, []uint64{0, 1, 2, 5, 7}, offsets(deliveries))
+
+	_, err = jobs.Append(&api.Record{TxnId: 3, Type: api.RecordType_COMMIT})
+	require.NoError(t, err)
+	deliveries, err = q.Receive("workers", "jobs", 10)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{8, 9}, offsets(deliveries))
+	for _, offset := range []uint64{0, 1, 2, 5, 7, 8, 9} {
+		require.NoError(t, q.Ack("workers", "jobs", offset))
+	}
+	// The last marker is skipped along with the next record
+	_, err = jobs.Append(&api.Record{})
+	require.NoError(t, err)
+	deliveries, err = q.Receive("workers", "jobs", 10)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{11}, offsets(deliveries))
+	require.NoError(t, q.Ack("workers", "jobs", 11))
+	require.Equal(t, uint64(12), q.subs["workers"].Floor)
+}
+
+func testDrop(t *testing.T, dir string, jobs, dead *log.MemoryLog) {
+	q, err := NewQueues(dir, Config{
+		VisibilityTimeout: time.Minute,
+		MaxDeliveries:     1,
+		Logs: func(name string) (Log, bool) {
+			return jobs, name == "jobs"
+		},
+	})
+	require.NoError(t, err)
+	defer q.Close()
+	now := time.Now()
+	q.now = func() time.Time { return now }
+
+	deliveries, err := q.Receive("workers", "jobs", 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, offsets(deliveries))
+	now = now.Add(time.Minute)
+	deliveries, err = q.Receive("workers", "jobs", 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, offsets(deliveries))
+	require.Equal(t, uint64(1), q.subs["workers"].Floor)
+}
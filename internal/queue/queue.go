@@ -0,0 +1,584 @@
+// Package queue reads logs as job queues. Consumers of a shared subscription
+// receive disjoint records from its log, each of which must be acknowledged
+// within a visibility timeout or it's delivered again. Records that keep
+// failing are moved to a dead-letter log.
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+	"github.com/alphaleph/yojimbo/internal/log"
+)
+
+// compactSlack is how many events the state log holds beyond one snapshot per
+// subscription before it's compacted.
+const compactSlack = 1024
+
+var (
+	// ErrNotDelivered is returned when acknowledging a record the
+	// subscription hasn't delivered.
+	ErrNotDelivered = errors.New("record wasn't delivered")
+	// ErrLogMismatch is returned when using a subscription with a log
+	// other than the one it was created for.
+	ErrLogMismatch = errors.New("subscription belongs to another log")
+)
+
+// Log is a log subscriptions read from or dead letters are appended to.
+type Log interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+}
+
+// committedReader is implemented by logs with transactions. Subscriptions
+// read them as read-committed readers do.
+type committedReader interface {
+	ReadCommitted(uint64) (*api.Record, error)
+}
+
+type Config struct {
+	// VisibilityTimeout is how long a delivered record has to be
+	// acknowledged before it's delivered again. Defaults to 30s.
+	VisibilityTimeout time.Duration
+	// MaxDeliveries is how many times a record is delivered before it's
+	// moved to the dead-letter log instead. Zero never gives up on it.
+	MaxDeliveries uint32
+	// DeadLetter is the log records are moved to after MaxDeliveries. If
+	// it's nil they're dropped, which is logged and counted in the
+	// dropped_records view.
+	DeadLetter Log
+	// Logs returns the named log to subscribe to.
+	Logs func(name string) (Log, bool)
+}
+
+// Delivery is a record delivered to a consumer.
+type Delivery struct {
+	Record *api.Record
+	// Attempt counts the deliveries of the record, from 1.
+	Attempt uint32
+}
+
+// subscription is a shared subscription's position in its log.
+type subscription struct {
+	// mu guards the subscription, so that its consumers don't hold up other
+	// subscriptions'.
+	mu  sync.Mutex
+	Log string `json:"log"`
+	// Every record before Floor was acknowledged, and Next is the next one
+	// to deliver for the first time.
+	Floor uint64 `json:"floor"`
+	Next  uint64 `json:"next"`
+	// Acked are the acknowledged records from Floor on and Attempts the
+	// delivery counts of the ones that weren't.
+	Acked    map[uint64]bool   `json:"acked"`
+	Attempts map[uint64]uint32 `json:"attempts"`
+
+	// leases are when unacknowledged records become visible again. They
+	// aren't persisted, so after a restart every such record is.
+	leases map[uint64]time.Time
+	// pending are the unacknowledged records without a lease, in order,
+	// which are due again. They're rebuilt from Attempts on load.
+	pending []uint64
+}
+
+func newSubscription(log string) *subscription {
+	return &subscription{
+		Log:      log,
+		Acked:    make(map[uint64]bool),
+		Attempts: make(map[uint64]uint32),
+		leases:   make(map[uint64]time.Time),
+	}
+}
+
+// apply applies a delivery or acknowledgement to the subscription.
+func (s *subscription) apply(e event) {
+	if e.Skip != nil {
+		s.skip(*e.Skip)
+	}
+	if e.Deliver != nil {
+		s.deliver(*e.Deliver)
+	}
+	if e.Ack != nil {
+		s.ack(*e.Ack)
+	}
+}
+
+func (s *subscription) deliver(offset uint64) {
+	if offset >= s.Next {
+		s.Next = offset + 1
+	}
+	s.Attempts[offset]++
+	s.unpend(offset)
+}
+
+// skip acknowledges the records from Next up to to, which aren't jobs.
+func (s *subscription) skip(to uint64) {
+	for ; s.Next < to; s.Next++ {
+		if s.Next >= s.Floor {
+			s.Acked[s.Next] = true
+		}
+	}
+	for s.Acked[s.Floor] {
+		delete(s.Acked, s.Floor)
+		s.Floor++
+	}
+}
+
+func (s *subscription) ack(offset uint64) {
+	if offset < s.Floor || s.Acked[offset] {
+		return
+	}
+	delete(s.Attempts, offset)
+	delete(s.leases, offset)
+	s.unpend(offset)
+	s.Acked[offset] = true
+	for s.Acked[s.Floor] {
+		delete(s.Acked, s.Floor)
+		s.Floor++
+	}
+}
+
+// repend marks every unacknowledged record as due, as they are once leases
+// are lost.
+func (s *subscription) repend() {
+	s.pending = s.pending[:0]
+	for offset := range s.Attempts {
+		s.pending = append(s.pending, offset)
+	}
+	sort.Slice(s.pending, func(i, j int) bool { return s.pending[i] < s.pending[j] })
+}
+
+func (s *subscription) unpend(offset uint64) {
+	i := sort.Search(len(s.pending), func(i int) bool { return s.pending[i] >= offset })
+	if i < len(s.pending) && s.pending[i] == offset {
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+	}
+}
+
+// event is a record in the state log.
+type event struct {
+	Subscription string        `json:"subscription"`
+	Deliver      *uint64       `json:"deliver,omitempty"`
+	Ack          *uint64       `json:"ack,omitempty"`
+	Skip         *uint64       `json:"skip,omitempty"`
+	Snapshot     *subscription `json:"snapshot,omitempty"`
+}
+
+// Queues keeps the shared subscriptions' state in a log of its own, so that
+// acknowledgements and delivery counts survive a restart.
+type Queues struct {
+	// mu guards subs, events and appending to the state log. A subscription's
+	// lock is taken before it.
+	mu     sync.Mutex
+	Config Config
+	state  *log.Log
+	subs   map[string]*subscription
+	// events counts the events in the state log.
+	events int
+	// compactMu keeps one compaction running at a time.
+	compactMu sync.Mutex
+	// now is the clock leases are timed by.
+	now func() time.Time
+}
+
+// NewQueues opens the state log in dir and reads back the subscriptions.
+func NewQueues(dir string, c Config) (*Queues, error) {
+	if c.VisibilityTimeout == 0 {
+		c.VisibilityTimeout = 30 * time.Second
+	}
+	state, err := log.NewLog(dir, log.Config{})
+	if err != nil {
+		return nil, err
+	}
+	q := &Queues{
+		Config: c,
+		state:  state,
+		subs:   make(map[string]*subscription),
+		now:    time.Now,
+	}
+	if err = q.load(); err != nil {
+		state.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queues) load() error {
+	offset, err := q.state.LowestOffset()
+	if err != nil {
+		return err
+	}
+	rec := &api.Record{}
+	for ; ; offset++ {
+		err := q.state.ReadInto(offset, rec)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			for _, s := range q.subs {
+				s.repend()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var e event
+		if err = json.Unmarshal(rec.Value, &e); err != nil {
+			return err
+		}
+		q.events++
+		q.apply(e)
+	}
+}
+
+// apply applies e to the subscriptions, both when it's logged and when it's
+// read back.
+func (q *Queues) apply(e event) {
+	if s := e.Snapshot; s != nil {
+		if s.Acked == nil {
+			s.Acked = make(map[uint64]bool)
+		}
+		if s.Attempts == nil {
+			s.Attempts = make(map[uint64]uint32)
+		}
+		if s.leases == nil {
+			s.leases = make(map[uint64]time.Time)
+		}
+		q.subs[e.Subscription] = s
+		return
+	}
+	if s, ok := q.subs[e.Subscription]; ok {
+		s.apply(e)
+	}
+}
+
+// Receive delivers up to max records of the named subscription to log,
+// creating the subscription at the start of the log if it doesn't exist.
+// Records whose visibility timeout expired are delivered again first.
+func (q *Queues) Receive(name, logName string, max int) ([]Delivery, error) {
+	l, ok := q.Config.Logs(logName)
+	if !ok {
+		return nil, fmt.Errorf("unknown log: %q", logName)
+	}
+	s, err := q.subscription(name, logName)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := q.receive(name, s, l, max)
+	if err != nil {
+		return deliveries, err
+	}
+	return deliveries, q.compactIfGrown()
+}
+
+func (q *Queues) receive(name string, s *subscription, l Log, max int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := skipTruncated(s, l); err != nil {
+		return nil, err
+	}
+	now := q.now()
+	var expired []uint64
+	for offset, deadline := range s.leases {
+		if !now.Before(deadline) {
+			expired = append(expired, offset)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+
+	var deliveries []Delivery
+	for _, offset := range expired {
+		if len(deliveries) == max {
+			return deliveries, nil
+		}
+		d, ok, err := q.deliver(name, s, l, offset, now)
+		if err != nil {
+			return deliveries, err
+		}
+		if ok {
+			deliveries = append(deliveries, d)
+		}
+	}
+	for len(deliveries) < max {
+		offset := s.Next
+		if len(s.pending) > 0 {
+			offset = s.pending[0]
+		}
+		d, ok, err := q.deliver(name, s, l, offset, now)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			break
+		}
+		if err != nil {
+			return deliveries, err
+		}
+		if ok {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+// deliver delivers the record at offset, or moves it to the dead-letter log
+// if it's been delivered too many times, in which case ok is false. The caller
+// must hold s.mu.
+func (q *Queues) deliver(name string, s *subscription, l Log, offset uint64, now time.Time) (d Delivery, ok bool, err error) {
+	rec, err := q.read(name, s, l, offset)
+	if err != nil {
+		return Delivery{}, false, err
+	}
+	offset = rec.Offset
+	if max := q.Config.MaxDeliveries; max > 0 && s.Attempts[offset] >= max {
+		if q.Config.DeadLetter != nil {
+			dead := &api.Record{Key: rec.Key, Value: rec.Value, Headers: rec.Headers}
+			if _, err = q.Config.DeadLetter.Append(dead); err != nil {
+				return Delivery{}, false, err
+			}
+		} else {
+			zap.L().Named("queue").Warn(
+				"dropped record after max deliveries without a dead-letter log",
+				zap.String("subscription", name),
+				zap.String("log", s.Log),
+				zap.Uint64("offset", offset),
+			)
+			err = stats.RecordWithTags(context.Background(), []tag.Mutator{
+				tag.Upsert(keySubscription, name),
+				tag.Upsert(keyLog, s.Log),
+			}, droppedRecords.M(1))
+			if err != nil {
+				return Delivery{}, false, err
+			}
+		}
+		if err = q.log(s, event{Subscription: name, Ack: &offset}); err != nil {
+			return Delivery{}, false, err
+		}
+		return Delivery{}, false, nil
+	}
+	if err = q.log(s, event{Subscription: name, Deliver: &offset}); err != nil {
+		return Delivery{}, false, err
+	}
+	s.leases[offset] = now.Add(q.Config.VisibilityTimeout)
+	return Delivery{Record: rec, Attempt: s.Attempts[offset]}, true, nil
+}
+
+// read returns the record at offset, or the first job after it if the
+// subscription hasn't reached it yet. Transaction markers are skipped, and so
+// are aborted records of logs with transactions, which are read up to their
+// oldest open transaction. Since read-committed reads hide markers, one at the
+// end of such a log is only skipped along with the record after it. The caller
+// must hold s.mu.
+func (q *Queues) read(name string, s *subscription, l Log, offset uint64) (*api.Record, error) {
+	if offset < s.Next {
+		return l.Read(offset)
+	}
+	read := l.Read
+	if r, ok := l.(committedReader); ok {
+		read = r.ReadCommitted
+	}
+	for {
+		rec, err := read(offset)
+		if err != nil {
+			return nil, err
+		}
+		to := rec.Offset
+		if rec.Type != api.RecordType_DATA {
+			to++
+		}
+		if to > s.Next {
+			if err = q.log(s, event{Subscription: name, Skip: &to}); err != nil {
+				return nil, err
+			}
+		}
+		if rec.Type == api.RecordType_DATA {
+			return rec, nil
+		}
+		offset = to
+	}
+}
+
+// skipTruncated moves the subscription past the records truncated from its
+// log, which can't be delivered anymore. The caller must hold s.mu.
+func skipTruncated(s *subscription, l Log) error {
+	tl, ok := l.(interface{ LowestOffset() (uint64, error) })
+	if !ok {
+		return nil
+	}
+	lowest, err := tl.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if lowest <= s.Floor {
+		return nil
+	}
+	for offset := range s.Acked {
+		if offset < lowest {
+			delete(s.Acked, offset)
+		}
+	}
+	for offset := range s.Attempts {
+		if offset < lowest {
+			delete(s.Attempts, offset)
+			delete(s.leases, offset)
+		}
+	}
+	i := sort.Search(len(s.pending), func(i int) bool { return s.pending[i] >= lowest })
+	s.pending = append(s.pending[:0], s.pending[i:]...)
+	s.Floor = lowest
+	for s.Acked[s.Floor] {
+		delete(s.Acked, s.Floor)
+		s.Floor++
+	}
+	if s.Next < s.Floor {
+		s.Next = s.Floor
+	}
+	return nil
+}
+
+// Ack acknowledges the delivered record at offset so it's never delivered
+// again. Acknowledging a record twice is a no-op.
+func (q *Queues) Ack(name, logName string, offset uint64) error {
+	q.mu.Lock()
+	s, ok := q.subs[name]
+	q.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNotDelivered, offset)
+	}
+	if err := q.ack(name, s, logName, offset); err != nil {
+		return err
+	}
+	return q.compactIfGrown()
+}
+
+func (q *Queues) ack(name string, s *subscription, logName string, offset uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset >= s.Next {
+		return fmt.Errorf("%w: %d", ErrNotDelivered, offset)
+	}
+	if s.Log != logName {
+		return ErrLogMismatch
+	}
+	if offset < s.Floor || s.Acked[offset] {
+		return nil
+	}
+	return q.log(s, event{Subscription: name, Ack: &offset})
+}
+
+// subscription returns the named subscription, creating it if it doesn't
+// exist.
+func (q *Queues) subscription(name, logName string) (*subscription, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s, ok := q.subs[name]; ok {
+		if s.Log != logName {
+			return nil, ErrLogMismatch
+		}
+		return s, nil
+	}
+	s := newSubscription(logName)
+	if err := q.append(event{Subscription: name, Snapshot: s}); err != nil {
+		return nil, err
+	}
+	q.subs[name] = s
+	return s, nil
+}
+
+// log appends e to the state log and applies it to s. The caller must hold
+// s.mu.
+func (q *Queues) log(s *subscription, e event) error {
+	q.mu.Lock()
+	err := q.append(e)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.apply(e)
+	return nil
+}
+
+// append appends e to the state log. The caller must hold q.mu.
+func (q *Queues) append(e event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = q.state.Append(&api.Record{Value: b}); err != nil {
+		return err
+	}
+	q.events++
+	return nil
+}
+
+// compactIfGrown compacts the state log once it holds more than compactSlack
+// events beyond a snapshot per subscription. The caller must hold no locks.
+func (q *Queues) compactIfGrown() error {
+	q.compactMu.Lock()
+	defer q.compactMu.Unlock()
+	q.mu.Lock()
+	grown := q.events > len(q.subs)+compactSlack
+	q.mu.Unlock()
+	if !grown {
+		return nil
+	}
+	return q.compact()
+}
+
+// compact appends a snapshot of every subscription and truncates the events
+// before them. Subscriptions are snapshotted one at a time, so events logged
+// meanwhile land after the cut and are replayed before or after the snapshot
+// they're part of.
+func (q *Queues) compact() error {
+	q.mu.Lock()
+	last, err := q.state.HighestOffset()
+	subs := make(map[string]*subscription, len(q.subs))
+	for name, s := range q.subs {
+		subs[name] = s
+	}
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for name, s := range subs {
+		if err = q.snapshot(name, s); err != nil {
+			return err
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err = q.state.Truncate(last); err != nil {
+		return err
+	}
+	// Truncation keeps the segment the snapshots start in
+	lowest, err := q.state.LowestOffset()
+	if err != nil {
+		return err
+	}
+	highest, err := q.state.HighestOffset()
+	if err != nil {
+		return err
+	}
+	q.events = int(highest - lowest + 1)
+	return nil
+}
+
+func (q *Queues) snapshot(name string, s *subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.append(event{Subscription: name, Snapshot: s})
+}
+
+// Close closes the state log.
+func (q *Queues) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.state.Close()
+}
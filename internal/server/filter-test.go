@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+func TestFilter(t *testing.T) {
+	rec := &api.Record{
+		Key:     "orders",
+		Offset:  7,
+		Headers: map[string]string{"region": "eu"},
+		Value:   []byte(`{"amount": 120, "customer": {"country": "DE"}}`),
+	}
+	for expression, match := range map[string]bool{
+		`key == "orders"`:                          true,
+		`offset >= 7 && offset < 8`:                true,
+		`[headers.region] == "eu"`:                 true,
+		`[headers.region] == "us"`:                 false,
+		`[headers.missing] == "eu"`:                false,
+		`[value.amount] > 100`:                     true,
+		`[value.customer.country] in ("DE", "FR")`: true,
+		// Comparing a missing field with a number can't be evaluated
+		`[value.missing] > 100`: false,
+	} {
+		f, err := newFilter(expression)
+		require.NoError(t, err, expression)
+		got, err := f.Match(rec)
+		require.NoError(t, err, expression)
+		require.Equal(t, match, got, expression)
+	}
+
+	// Values that aren't JSON have no fields
+	f, err := newFilter(`[value.amount] > 100`)
+	require.NoError(t, err)
+	got, err := f.Match(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.False(t, got)
+
+	for _, expression := range []string{
+		`key ==`,
+		`size > 10`,
+		`headers.Region == "eu"`,
+	} {
+		_, err := newFilter(expression)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), expression)
+	}
+	f, err = newFilter(`offset + 1`)
+	require.NoError(t, err)
+	_, err = f.Match(rec)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// No filter matches everything
+	f, err = newFilter("")
+	require.NoError(t, err)
+	got, err = f.Match(rec)
+	require.NoError(t, err)
+	require.True(t, got)
+}
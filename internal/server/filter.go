@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// maxSkipped is how many records a consume skips for not matching its filter
+// before reporting its progress without a record.
+const maxSkipped = 1024
+
+// filter matches records against a consume request's filter expression.
+type filter struct {
+	expr *govaluate.EvaluableExpression
+}
+
+// newFilter parses the expression, returning nil if it's empty.
+func newFilter(expression string) (*filter, error) {
+	if expression == "" {
+		return nil, nil
+	}
+	expr, err := govaluate.NewEvaluableExpression(expression)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+	}
+	for _, token := range expr.Tokens() {
+		switch token.Kind {
+		case govaluate.ACCESSOR:
+			// Headers and fields have to be escaped, as in [headers.name]
+			return nil, status.Errorf(codes.InvalidArgument, "invalid filter: unknown parameter %q", strings.Join(token.Value.([]string), "."))
+		case govaluate.VARIABLE:
+			if name := token.Value.(string); !validParameter(name) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid filter: unknown parameter %q", name)
+			}
+		}
+	}
+	return &filter{expr: expr}, nil
+}
+
+// Match reports whether rec matches the filter. Records the expression can't
+// be evaluated against, e.g. for comparing a missing header, don't match.
+func (f *filter) Match(rec *api.Record) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	result, err := f.expr.Eval(&recordParameters{rec: rec})
+	if err != nil {
+		return false, nil
+	}
+	match, ok := result.(bool)
+	if !ok {
+		return false, status.Errorf(codes.InvalidArgument, "filter returned %v rather than a bool", result)
+	}
+	return match, nil
+}
+
+func validParameter(name string) bool {
+	switch name {
+	case "key", "offset", "timestamp", "value":
+		return true
+	}
+	return strings.HasPrefix(name, "headers.") || strings.HasPrefix(name, "value.")
+}
+
+// recordParameters exposes a record to filter expressions. Headers and value
+// fields that aren't there are nil.
+type recordParameters struct {
+	rec *api.Record
+	// value is the record's value decoded from JSON, once a field of it is
+	// asked for.
+	value   interface{}
+	decoded bool
+}
+
+func (p *recordParameters) Get(name string) (interface{}, error) {
+	switch name {
+	case "key":
+		return p.rec.Key, nil
+	case "offset":
+		return float64(p.rec.Offset), nil
+	case "timestamp":
+		return float64(p.rec.Timestamp), nil
+	}
+	if header, ok := strings.CutPrefix(name, "headers."); ok {
+		if v, ok := p.rec.Headers[header]; ok {
+			return v, nil
+		}
+		return nil, nil
+	}
+	if !p.decoded {
+		p.decoded = true
+		// Values that aren't JSON have no fields
+		if err := json.Unmarshal(p.rec.Value, &p.value); err != nil {
+			p.value = nil
+		}
+	}
+	v := p.value
+	if name == "value" {
+		return v, nil
+	}
+	for _, field := range strings.Split(strings.TrimPrefix(name, "value."), ".") {
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		v = object[field]
+	}
+	return v, nil
+}
@@ -2,13 +2,17 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/gorilla/mux"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+	"github.com/alphaleph/yojimbo/internal/log"
 )
 
 type httpServer struct {
-	Log *Log
+	Log CommitLog
 }
 
 func (s *httpServer) readLog(w http.ResponseWriter, r *http.Request) {
@@ -19,7 +23,7 @@ func (s *httpServer) readLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
@@ -42,7 +46,15 @@ func (s *httpServer) writeLog(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if req.Record == nil {
+		http.Error(w, "record is required", http.StatusBadRequest)
+		return
+	}
 	offset, err := s.Log.Append(req.Record)
+	if errors.As(err, &api.ErrQuotaExceeded{}) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -59,10 +71,10 @@ type ReadRequest struct {
 	Offset uint64 `json:"offset"`
 }
 type ReadResponse struct {
-	Record Record `json:"record"`
+	Record *api.Record `json:"record"`
 }
 type WriteRequest struct {
-	Record Record `json:"record"`
+	Record *api.Record `json:"record"`
 }
 type WriteResponse struct {
 	Offset uint64 `json:"offset"`
@@ -83,6 +95,6 @@ func NewHTTPServer(addr string) *http.Server {
 
 func newHTTPServer() *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		Log: log.NewMemoryLog(log.Config{}),
 	}
 }
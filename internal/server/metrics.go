@@ -0,0 +1,66 @@
+package server
+
+import (
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	keyGroup = tag.MustNewKey("yojimbo_group")
+	keyLog   = tag.MustNewKey("yojimbo_log")
+
+	committedOffset = stats.Int64(
+		"yojimbo/group/committed_offset",
+		"Offset a consumer group last committed for a log",
+		stats.UnitDimensionless,
+	)
+	highestOffset = stats.Int64(
+		"yojimbo/group/highest_offset",
+		"Offset of the newest record of a log a consumer group reads",
+		stats.UnitDimensionless,
+	)
+	lagRecords = stats.Int64(
+		"yojimbo/group/lag_records",
+		"Number of records a consumer group has yet to consume from a log",
+		stats.UnitDimensionless,
+	)
+	lagSeconds = stats.Float64(
+		"yojimbo/group/lag_seconds",
+		"Estimated time a consumer group takes to catch up with a log",
+		stats.UnitSeconds,
+	)
+)
+
+// Views reports the latest lag of each consumer group by log. They're
+// registered by NewGRPCServer.
+var Views = []*view.View{
+	{
+		Name:        committedOffset.Name(),
+		Description: committedOffset.Description(),
+		Measure:     committedOffset,
+		TagKeys:     []tag.Key{keyGroup, keyLog},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        highestOffset.Name(),
+		Description: highestOffset.Description(),
+		Measure:     highestOffset,
+		TagKeys:     []tag.Key{keyGroup, keyLog},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        lagRecords.Name(),
+		Description: lagRecords.Description(),
+		Measure:     lagRecords,
+		TagKeys:     []tag.Key{keyGroup, keyLog},
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        lagSeconds.Name(),
+		Description: lagSeconds.Description(),
+		Measure:     lagSeconds,
+		TagKeys:     []tag.Key{keyGroup, keyLog},
+		Aggregation: view.LastValue(),
+	},
+}
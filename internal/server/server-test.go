@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"flag"
+	"io"
 	"net"
 	"os"
 	"testing"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/alphaleph.yojimbo/internal/config"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -21,7 +23,11 @@ import (
 	api "github.com/alphaleph/yojimbo/api/v1"
 	auth "github.com/alphaleph/yojimbo/internal/auth"
 	"github.com/alphaleph/yojimbo/internal/config"
-	"github.com/alphaleph/yojimbo/internal/log"
+	"github.com/alphaleph/yojimbo/internal/group"
+	ilog "github.com/alphaleph/yojimbo/internal/log"
+	"github.com/alphaleph/yojimbo/internal/queue"
+	"github.com/alphaleph/yojimbo/internal/txn"
+	"github.com/alphaleph/yojimbo/pkg/log"
 )
 
 var debug = flag.Bool("debug", false, "Enable observability for debugging.")
@@ -49,6 +55,18 @@ func TestServer(t *testing.T) {
 		"produce/consume stream":                testProduceConsumeStream,
 		"consume exceeding log boundary fails":  testConsumePastBoundary,
 		"unauthorized fails":                    testUnauthorized,
+		"get corrupt ranges":                    testGetCorruptRanges,
+		"idempotent produce":                    testIdempotentProduce,
+		"idempotent produce to a named log":     testIdempotentProduceNamedLog,
+		"conditional produce":                   testConditionalProduce,
+		"read stream":                           testReadStream,
+		"transactions":                          testTransactions,
+		"committed offsets":                     testCommittedOffsets,
+		"consumer group membership":             testGroupMembership,
+		"shared subscriptions":                  testSharedSubscriptions,
+		"consumer lag":                          testConsumerLag,
+		"start positions":                       testStartPositions,
+		"filtered consume":                      testFilteredConsume,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, guestClient, config, teardown := setupTest(t, nil)
@@ -103,15 +121,44 @@ func setupTest(t *testing.T, fn func(*Config)) (api.LogClient, api.LogClient, *C
 	dir, err := os.MkdirTemp("", "server-test")
 	require.NoError(t, err)
 
-	clog, err := log.NewLog(dir, log.Config{})
+	clog, err := log.Open(dir)
+	require.NoError(t, err)
+	otherDir, err := os.MkdirTemp("", "server-test-other")
+	require.NoError(t, err)
+	other, err := log.Open(otherDir)
+	require.NoError(t, err)
+	txnDir, err := os.MkdirTemp("", "server-test-txns")
+	require.NoError(t, err)
+	txns, err := txn.NewCoordinator(txnDir, map[string]txn.Participant{
+		"":      clog,
+		"other": other,
+	}, txn.Config{})
+	require.NoError(t, err)
+	offsetsDir, err := os.MkdirTemp("", "server-test-offsets")
+	require.NoError(t, err)
+	offsets, err := ilog.NewOffsets(offsetsDir, ilog.Config{})
 	require.NoError(t, err)
 
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 
 	cfg := &Config{
 		CommitLog:  clog,
+		Logs:       map[string]CommitLog{"other": other},
 		Authorizer: authorizer,
+		Txns:       txns,
+		Offsets:    offsets,
 	}
+	cfg.Groups = group.NewCoordinator(group.Config{Partitions: cfg.Partitions})
+	queuesDir, err := os.MkdirTemp("", "server-test-queues")
+	require.NoError(t, err)
+	queues, err := queue.NewQueues(queuesDir, queue.Config{
+		Logs: func(name string) (queue.Log, bool) {
+			l, ok := cfg.Log(name)
+			return l, ok
+		},
+	})
+	require.NoError(t, err)
+	cfg.Queues = queues
 
 	var telemetryExporter *exporter.LogExporter
 	if *debug {
@@ -148,6 +195,13 @@ func setupTest(t *testing.T, fn func(*Config)) (api.LogClient, api.LogClient, *C
 		guestConn.Close()
 		l.Close()
 		clog.Remove()
+		other.Remove()
+		txns.Close()
+		os.RemoveAll(txnDir)
+		offsets.Close()
+		os.RemoveAll(offsetsDir)
+		queues.Close()
+		os.RemoveAll(queuesDir)
 		if telemetryExporter != nil {
 			time.Sleep(1500 * time.Millisecond) // Some time to flush data to disk
 			telemetryExporter.Stop()
@@ -215,10 +269,9 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		for i, rec := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  rec.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, rec.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotZero(t, res.Record.Timestamp)
 		}
 	}
 }
@@ -276,4 +329,456 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 	if gotCode != expectedCode {
 		t.Fatalf("got code: %d, expected: %d", gotCode, expectedCode)
 	}
+	_, err = client.GetCorruptRanges(ctx, &api.GetCorruptRangesRequest{})
+	gotCode, expectedCode = status.Code(err), codes.PermissionDenied
+	if gotCode != expectedCode {
+		t.Fatalf("got code: %d, expected: %d", gotCode, expectedCode)
+	}
+}
+
+func testGetCorruptRanges(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	res, err := client.GetCorruptRanges(ctx, &api.GetCorruptRangesRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.Ranges)
+	_, err = client.GetCorruptRanges(ctx, &api.GetCorruptRangesRequest{Log: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testIdempotentProduce(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	producer, err := client.InitProducer(ctx, &api.InitProducerRequest{})
+	require.NoError(t, err)
+	produce := func(seq uint64) (*api.ProduceResponse, error) {
+		return client.Produce(ctx, &api.ProduceRequest{
+			Record:     &api.Record{Value: []byte("hello world")},
+			ProducerId: producer.ProducerId,
+			Sequence:   seq,
+		})
+	}
+	first, err := produce(0)
+	require.NoError(t, err)
+	retry, err := produce(0)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, retry.Offset)
+	_, err = produce(2)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	next, err := produce(1)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset+1, next.Offset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: first.Offset})
+	require.NoError(t, err)
+	require.Equal(t, producer.ProducerId, consume.Record.ProducerId)
+	require.Equal(t, uint64(0), consume.Record.Sequence)
+}
+
+func testIdempotentProduceNamedLog(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	producer, err := client.InitProducer(ctx, &api.InitProducerRequest{Log: "other"})
+	require.NoError(t, err)
+	produce := func(seq uint64) (*api.ProduceResponse, error) {
+		return client.Produce(ctx, &api.ProduceRequest{
+			Record:     &api.Record{Value: []byte("hello world")},
+			ProducerId: producer.ProducerId,
+			Sequence:   seq,
+			Log:        "other",
+		})
+	}
+	first, err := produce(0)
+	require.NoError(t, err)
+	retry, err := produce(0)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, retry.Offset)
+	next, err := produce(1)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset+1, next.Offset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: first.Offset, Log: "other"})
+	require.NoError(t, err)
+	require.Equal(t, producer.ProducerId, consume.Record.ProducerId)
+	// Nothing went to the default log
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: first.Offset})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	_, err = client.InitProducer(ctx, &api.InitProducerRequest{Log: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testConditionalProduce(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce := func(expected uint64) (*api.ProduceResponse, error) {
+		return client.Produce(ctx, &api.ProduceRequest{
+			Record:         &api.Record{Value: []byte("hello world")},
+			ExpectedOffset: &expected,
+		})
+	}
+	res, err := produce(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	_, err = produce(0)
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	var actual string
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			actual = info.Metadata["actual_offset"]
+		}
+	}
+	require.Equal(t, "1", actual)
+
+	res, err = produce(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+}
+
+func testReadStream(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i, key := range []string{"order-42", "order-43", "order-42"} {
+		expected := uint64(i / 2)
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:          &api.Record{Key: key, Value: []byte(key)},
+			ExpectedVersion: &expected,
+		})
+		require.NoError(t, err)
+	}
+	expected := uint64(1)
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:          &api.Record{Key: "order-42"},
+		ExpectedVersion: &expected,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	stream, err := client.ReadStream(ctx, &api.ReadStreamRequest{Key: "order-42"})
+	require.NoError(t, err)
+	for version, offset := range []uint64{0, 2} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, offset, res.Record.Offset)
+		require.Equal(t, uint64(version), res.Record.Version)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// Streams are per log
+	stream, err = client.ReadStream(ctx, &api.ReadStreamRequest{Key: "order-42", Log: "other"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func testTransactions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce := func(log string, txnID uint64) uint64 {
+		t.Helper()
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+			Log:    log,
+			TxnId:  txnID,
+		})
+		require.NoError(t, err)
+		return res.Offset
+	}
+	consume := func(log string, offset uint64) (*api.Record, error) {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset:        offset,
+			Log:           log,
+			ReadCommitted: true,
+		})
+		return res.GetRecord(), err
+	}
+
+	begin, err := client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.NoError(t, err)
+	first := produce("", begin.TxnId)
+	produce("other", begin.TxnId)
+	_, err = consume("", first)
+	require.Equal(t, codes.Code(404), status.Code(err))
+	_, err = client.CommitTxn(ctx, &api.CommitTxnRequest{TxnId: begin.TxnId})
+	require.NoError(t, err)
+	for _, log := range []string{"", "other"} {
+		rec, err := consume(log, 0)
+		require.NoError(t, err)
+		require.Equal(t, begin.TxnId, rec.TxnId)
+	}
+
+	// Aborted records and markers are skipped
+	begin, err = client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.NoError(t, err)
+	aborted := produce("", begin.TxnId)
+	_, err = client.AbortTxn(ctx, &api.AbortTxnRequest{TxnId: begin.TxnId})
+	require.NoError(t, err)
+	next := produce("", 0)
+	rec, err := consume("", aborted)
+	require.NoError(t, err)
+	require.Equal(t, next, rec.Offset)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		TxnId:  begin.TxnId,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testCommittedOffsets(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	fetch, err := client.FetchCommittedOffset(ctx, &api.FetchCommittedOffsetRequest{
+		Group: "billing",
+	})
+	require.NoError(t, err)
+	require.Nil(t, fetch.Offset)
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "billing",
+		Log:    "other",
+		Offset: 42,
+	})
+	require.NoError(t, err)
+	fetch, err = client.FetchCommittedOffset(ctx, &api.FetchCommittedOffsetRequest{
+		Group: "billing",
+		Log:   "other",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), fetch.GetOffset())
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "billing",
+		Log:   "missing",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testGroupMembership(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	join := func() *api.JoinGroupResponse {
+		t.Helper()
+		res, err := client.JoinGroup(ctx, &api.JoinGroupRequest{
+			Group:    "billing",
+			Logs:     []string{"", "other"},
+			Strategy: api.AssignmentStrategy_ROUND_ROBIN,
+		})
+		require.NoError(t, err)
+		return res
+	}
+	first := join()
+	require.Len(t, first.Assignments, 2)
+	second := join()
+	require.Len(t, second.Assignments, 1)
+
+	// The first member's commit is fenced until it heartbeats
+	commit := &api.CommitOffsetRequest{
+		Group:      "billing",
+		Offset:     1,
+		MemberId:   first.MemberId,
+		Generation: first.Generation,
+	}
+	_, err := client.CommitOffset(ctx, commit)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	hb, err := client.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, second.Generation, hb.Generation)
+	require.Len(t, hb.Assignments, 1)
+	commit.Generation = hb.Generation
+	_, err = client.CommitOffset(ctx, commit)
+	require.NoError(t, err)
+
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{
+		Group:    "billing",
+		MemberId: second.MemberId,
+	})
+	require.NoError(t, err)
+	hb, err = client.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	})
+	require.NoError(t, err)
+	require.Len(t, hb.Assignments, 2)
+}
+
+func testSharedSubscriptions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for _, value := range []string{"first", "second", "third"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+
+	receive := &api.ReceiveRequest{Subscription: "workers", MaxRecords: 2}
+	first, err := client.Receive(ctx, receive)
+	require.NoError(t, err)
+	require.Len(t, first.Deliveries, 2)
+	require.Equal(t, []byte("first"), first.Deliveries[0].Record.Value)
+	require.Equal(t, uint32(1), first.Deliveries[0].Attempt)
+	second, err := client.Receive(ctx, receive)
+	require.NoError(t, err)
+	require.Len(t, second.Deliveries, 1)
+	require.Equal(t, []byte("third"), second.Deliveries[0].Record.Value)
+
+	_, err = client.Ack(ctx, &api.AckRequest{
+		Subscription: "workers",
+		Offsets:      []uint64{0, 1, 2},
+	})
+	require.NoError(t, err)
+	_, err = client.Ack(ctx, &api.AckRequest{
+		Subscription: "workers",
+		Offsets:      []uint64{3},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	receive.Log = "other"
+	_, err = client.Receive(ctx, receive)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	receive.Log = "missing"
+	_, err = client.Receive(ctx, receive)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testConsumerLag(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	joined, err := client.JoinGroup(ctx, &api.JoinGroupRequest{
+		Group: "billing",
+		Logs:  []string{""},
+	})
+	require.NoError(t, err)
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:      "billing",
+		Offset:     1,
+		MemberId:   joined.MemberId,
+		Generation: joined.Generation,
+	})
+	require.NoError(t, err)
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "audit",
+		Log:   "other",
+	})
+	require.NoError(t, err)
+
+	lag, err := client.GetLag(ctx, &api.GetLagRequest{Group: "billing"})
+	require.NoError(t, err)
+	require.Len(t, lag.Lags, 1)
+	require.Equal(t, uint64(1), lag.Lags[0].CommittedOffset)
+	require.Equal(t, uint64(2), lag.Lags[0].HighestOffset)
+	require.Equal(t, uint64(2), lag.Lags[0].Lag)
+	// A single commit doesn't tell how fast the group consumes
+	require.Nil(t, lag.Lags[0].LagSeconds)
+
+	// The other log is empty, so its group isn't behind
+	lag, err = client.GetLag(ctx, &api.GetLagRequest{})
+	require.NoError(t, err)
+	require.Len(t, lag.Lags, 2)
+	require.Equal(t, "audit", lag.Lags[0].Group)
+	require.Equal(t, uint64(0), lag.Lags[0].Lag)
+
+	group, err := client.DescribeGroup(ctx, &api.DescribeGroupRequest{Group: "billing"})
+	require.NoError(t, err)
+	require.Equal(t, joined.Generation, group.Generation)
+	require.Len(t, group.Members, 1)
+	require.Equal(t, joined.MemberId, group.Members[0].MemberId)
+	require.Len(t, group.Members[0].Assignments, 1)
+	require.Len(t, group.Lags, 1)
+}
+
+func testStartPositions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	var timestamps []int64
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+		res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: uint64(i)})
+		require.NoError(t, err)
+		timestamps = append(timestamps, res.Record.Timestamp)
+		// The next record is appended a millisecond later
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	consume := func(req *api.ConsumeRequest) (uint64, error) {
+		t.Helper()
+		res, err := client.Consume(ctx, req)
+		if err != nil {
+			return 0, err
+		}
+		return res.Record.Offset, nil
+	}
+	offset, err := consume(&api.ConsumeRequest{Start: api.StartPosition_EARLIEST})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	offset, err = consume(&api.ConsumeRequest{
+		Start:     api.StartPosition_AT_TIMESTAMP,
+		Timestamp: timestamps[1],
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+	// Nothing has been appended since LATEST
+	_, err = consume(&api.ConsumeRequest{Start: api.StartPosition_LATEST})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	committed := &api.ConsumeRequest{
+		Start: api.StartPosition_COMMITTED,
+		Group: "billing",
+	}
+	_, err = consume(committed)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	committed.ResetPolicy = api.OffsetReset_RESET_EARLIEST
+	offset, err = consume(committed)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "billing",
+		Offset: 2,
+	})
+	require.NoError(t, err)
+	offset, err = consume(committed)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+}
+
+func testFilteredConsume(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for _, region := range []string{"eu", "us", "eu", "us", "us"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:   []byte("hello world"),
+				Headers: map[string]string{"region": region},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	req := &api.ConsumeRequest{Filter: `[headers.region] == "eu"`}
+	stream, err := client.ConsumeStream(ctx, req)
+	require.NoError(t, err)
+	for _, offset := range []uint64{0, 2} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, offset, res.Record.Offset)
+		require.Equal(t, offset+1, res.NextOffset)
+	}
+	// The records skipped at the end are reported without one
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+	require.Equal(t, uint64(5), res.NextOffset)
+
+	req.Offset = 3
+	consume, err := client.Consume(ctx, req)
+	require.NoError(t, err)
+	require.Nil(t, consume.Record)
+	require.Equal(t, uint64(5), consume.NextOffset)
+
+	req.Filter = `[headers.region] ==`
+	_, err = client.Consume(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
 }
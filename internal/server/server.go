@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"errors"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -17,12 +19,17 @@ import (
 	"google.golang.org/grpc/status"
 
 	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	api "github.com/alphaleph/yojimbo/api/v1"
+	"github.com/alphaleph/yojimbo/internal/group"
+	"github.com/alphaleph/yojimbo/internal/log"
+	"github.com/alphaleph/yojimbo/internal/queue"
 )
 
 type CommitLog interface {
@@ -30,6 +37,93 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
+// recordReader is implemented by commit logs that can decode a record into a
+// caller-supplied one, letting streams reuse a single record.
+type recordReader interface {
+	ReadInto(uint64, *api.Record) error
+}
+
+// corruptionReporter is implemented by commit logs that scrub their records
+// for corruption.
+type corruptionReporter interface {
+	CorruptRanges() []*api.OffsetRange
+}
+
+// producerRegistry is implemented by commit logs that deduplicate records
+// from idempotent producers.
+type producerRegistry interface {
+	InitProducer() (uint64, error)
+}
+
+// conditionalAppender is implemented by commit logs that can append a record
+// only at an expected offset.
+type conditionalAppender interface {
+	AppendAt(expected uint64, rec *api.Record) (uint64, error)
+}
+
+// streamIndexer is implemented by commit logs that index records by key.
+type streamIndexer interface {
+	AppendVersion(expected uint64, rec *api.Record) (uint64, error)
+	StreamOffsets(key string, from uint64) ([]uint64, error)
+}
+
+// offsetBounds is implemented by commit logs that report the range of offsets
+// they hold, which lag is measured against and consumers are reset to.
+type offsetBounds interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+}
+
+// timestampIndexer is implemented by commit logs that can look records up by
+// the time they were appended.
+type timestampIndexer interface {
+	OffsetAt(timestamp int64) (uint64, error)
+}
+
+// committedReader is implemented by commit logs that can hide uncommitted
+// transactional records from readers.
+type committedReader interface {
+	ReadCommitted(uint64) (*api.Record, error)
+}
+
+// TxnCoordinator begins and ends transactions spanning the server's logs.
+type TxnCoordinator interface {
+	Begin() (uint64, error)
+	// Write runs write, which appends records of the transaction to the
+	// named log.
+	Write(id uint64, name string, write func() error) error
+	Commit(id uint64) error
+	Abort(id uint64) error
+}
+
+// OffsetStore persists the offsets consumer groups commit.
+type OffsetStore interface {
+	Commit(key log.OffsetKey, offset uint64) error
+	Fetch(key log.OffsetKey) (uint64, bool)
+	// Positions returns the positions the group committed, or those of
+	// every group if it's empty.
+	Positions(group string) []log.Position
+}
+
+// GroupCoordinator tracks consumer group members and assigns them partitions.
+type GroupCoordinator interface {
+	Join(groupID, memberID string, logs []string, strategy group.Strategy, timeout time.Duration) (group.Membership, error)
+	Heartbeat(groupID, memberID string) (group.Membership, error)
+	Leave(groupID, memberID string) error
+	// Describe returns the memberships of the group's current members.
+	Describe(groupID string) []group.Membership
+	// Validate returns an error unless the member is in the group's
+	// current generation.
+	Validate(groupID, memberID string, generation uint64) error
+}
+
+// SharedSubscriptions deliver each record of a log to one of a subscription's
+// consumers, until it's acknowledged.
+type SharedSubscriptions interface {
+	Receive(name, log string, max int) ([]queue.Delivery, error)
+	Ack(name, log string, offset uint64) error
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
@@ -37,14 +131,46 @@ type Authorizer interface {
 type subjectContextKey struct{}
 
 type Config struct {
+	// CommitLog is the default log, and Logs are more logs by name.
 	CommitLog  CommitLog
+	Logs       map[string]CommitLog
 	Authorizer Authorizer
+	// Txns coordinates transactions across the logs. Leave it nil to
+	// disable transactions.
+	Txns TxnCoordinator
+	// Offsets stores consumer groups' offsets. Leave it nil to disable
+	// consumer groups.
+	Offsets OffsetStore
+	// Groups coordinates consumer group membership. Leave it nil to only
+	// store offsets, without fencing their commits.
+	Groups GroupCoordinator
+	// Queues serves shared subscriptions. Leave it nil to disable them.
+	Queues SharedSubscriptions
+}
+
+// Log returns the named log, or the default one for an empty name.
+func (c *Config) Log(name string) (CommitLog, bool) {
+	if name == "" {
+		return c.CommitLog, true
+	}
+	l, ok := c.Logs[name]
+	return l, ok
+}
+
+// Partitions returns the number of partitions of the named log, for the group
+// coordinator. Logs aren't partitioned, so every log has one.
+func (c *Config) Partitions(name string) (uint32, bool) {
+	if _, ok := c.Log(name); !ok {
+		return 0, false
+	}
+	return 1, true
 }
 
 const (
 	wildcard      = "*"
 	produceAction = "produce"
 	consumeAction = "consume"
+	adminAction   = "admin"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -70,6 +196,9 @@ func NewGRPCServer(c *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, erro
 	if err != nil {
 		return nil, err
 	}
+	if err = view.Register(Views...); err != nil {
+		return nil, err
+	}
 
 	grpcOpts = append(grpcOpts,
 		grpc.StreamInterceptor(
@@ -97,9 +226,15 @@ func NewGRPCServer(c *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, erro
 	return gsrv, nil
 }
 
+// lagInterval is how often produces refresh the lag views at most.
+const lagInterval = time.Second
+
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	// lagRecordedAt is when the lag views were last refreshed, in Unix
+	// nanoseconds.
+	lagRecordedAt atomic.Int64
 }
 
 func newgrpcServer(c *Config) (*grpcServer, error) {
@@ -114,23 +249,56 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 		return nil, err
 	}
 
-	rec, err := s.CommitLog.Read(req.Offset)
+	l, err := s.log(req.Log)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ConsumeResponse{Record: rec}, nil
+	f, err := newFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.seek(l, req); err != nil {
+		return nil, err
+	}
+	res := &api.ConsumeResponse{}
+	if err = s.next(l, req, f, res, &api.Record{}); err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	if err := s.Authorizer.Authorize(stream.Context().Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return err
+	}
+
+	l, err := s.log(req.Log)
+	if err != nil {
+		return err
+	}
+	f, err := newFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+	if err = s.seek(l, req); err != nil {
+		return err
+	}
+	res := &api.ConsumeResponse{}
+	rec := &api.Record{}
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			err := s.next(l, req, f, res, rec)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// Wait for the record to be appended, unless it was
+				// truncated and the reset policy is to fail
+				if lowest, _, berr := bounds(l); berr == nil && req.Offset < lowest {
+					return err
+				}
 				continue
 			default:
 				return err
@@ -139,23 +307,240 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			req.Offset++
 		}
 	}
 }
 
+// log returns the named log, or the default one for an empty name.
+func (s *grpcServer) log(name string) (CommitLog, error) {
+	l, ok := s.Config.Log(name)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown log: %q", name)
+	}
+	return l, nil
+}
+
+// seek resolves the request's start position into its offset.
+func (s *grpcServer) seek(l CommitLog, req *api.ConsumeRequest) error {
+	var err error
+	switch req.Start {
+	case api.StartPosition_OFFSET:
+	case api.StartPosition_EARLIEST:
+		req.Offset, _, err = bounds(l)
+	case api.StartPosition_LATEST:
+		_, req.Offset, err = bounds(l)
+	case api.StartPosition_AT_TIMESTAMP:
+		t, ok := l.(timestampIndexer)
+		if !ok {
+			return status.Error(codes.Unimplemented, "commit log doesn't look up timestamps")
+		}
+		req.Offset, err = t.OffsetAt(req.Timestamp)
+	case api.StartPosition_COMMITTED:
+		if s.Offsets == nil {
+			return status.Error(codes.Unimplemented, "consumer groups aren't enabled")
+		}
+		if req.Group == "" {
+			return status.Error(codes.InvalidArgument, "missing group")
+		}
+		offset, ok := s.Offsets.Fetch(log.OffsetKey{Group: req.Group, Log: req.Log})
+		if ok {
+			req.Offset = offset
+			return nil
+		}
+		// A group that hasn't committed starts where it would be reset to
+		if req.ResetPolicy == api.OffsetReset_FAIL {
+			return status.Errorf(codes.NotFound, "group %q hasn't committed an offset for log %q", req.Group, req.Log)
+		}
+		req.Offset, err = reset(l, req.ResetPolicy)
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown start position: %v", req.Start)
+	}
+	return err
+}
+
+// next reads the next record matching the filter from l into res, moving the
+// request's offset past it. After skipping maxSkipped records, or reaching the
+// end of the log having skipped some, it reports its progress in res without a
+// record instead.
+func (s *grpcServer) next(l CommitLog, req *api.ConsumeRequest, f *filter, res *api.ConsumeResponse, rec *api.Record) error {
+	for skipped := 0; skipped < maxSkipped; skipped++ {
+		r, err := s.consume(l, req, rec)
+		if skipped > 0 && errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Read-committed reads may skip ahead
+		req.Offset = r.Offset + 1
+		match, err := f.Match(r)
+		if err != nil {
+			return err
+		}
+		if match {
+			res.Record, res.NextOffset = r, req.Offset
+			return nil
+		}
+	}
+	res.Record, res.NextOffset = nil, req.Offset
+	return nil
+}
+
+// consume reads the record the request asks for from l. If the request's
+// offset was truncated, it's moved as its reset policy says first.
+func (s *grpcServer) consume(l CommitLog, req *api.ConsumeRequest, rec *api.Record) (*api.Record, error) {
+	res, err := s.readRequested(l, req, rec)
+	if !errors.As(err, &api.ErrOffsetOutOfRange{}) || req.ResetPolicy == api.OffsetReset_FAIL {
+		return res, err
+	}
+	lowest, _, berr := bounds(l)
+	if berr != nil {
+		return nil, berr
+	}
+	if req.Offset >= lowest {
+		// Past the end rather than truncated
+		return nil, err
+	}
+	if req.Offset, err = reset(l, req.ResetPolicy); err != nil {
+		return nil, err
+	}
+	return s.readRequested(l, req, rec)
+}
+
+// readRequested reads the record at the request's offset from l.
+func (s *grpcServer) readRequested(l CommitLog, req *api.ConsumeRequest, rec *api.Record) (*api.Record, error) {
+	if !req.ReadCommitted {
+		return s.read(l, req.Offset, rec)
+	}
+	r, ok := l.(committedReader)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log doesn't support read committed")
+	}
+	return r.ReadCommitted(req.Offset)
+}
+
+// reset returns the offset the policy moves a consumer whose offset is out of
+// range to.
+func reset(l CommitLog, policy api.OffsetReset) (uint64, error) {
+	lowest, end, err := bounds(l)
+	if err != nil {
+		return 0, err
+	}
+	switch policy {
+	case api.OffsetReset_RESET_EARLIEST:
+		return lowest, nil
+	case api.OffsetReset_RESET_LATEST:
+		return end, nil
+	}
+	return 0, status.Errorf(codes.InvalidArgument, "unknown reset policy: %v", policy)
+}
+
+// bounds returns the lowest offset of l and the offset the next record
+// appended to it gets.
+func bounds(l CommitLog) (lowest, end uint64, err error) {
+	b, ok := l.(offsetBounds)
+	if !ok {
+		return 0, 0, status.Error(codes.Unimplemented, "commit log doesn't report its offsets")
+	}
+	if lowest, err = b.LowestOffset(); err != nil {
+		return 0, 0, err
+	}
+	highest, err := b.HighestOffset()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case lowest > highest:
+		// Empty since it was truncated
+		return lowest, lowest, nil
+	case highest == 0:
+		// An empty log and one with a single record both report 0
+		if _, err = l.Read(0); errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return 0, 0, nil
+		} else if err != nil {
+			return 0, 0, err
+		}
+	}
+	return lowest, highest + 1, nil
+}
+
+// read reads the record at offset from l, decoding it into rec when the
+// commit log supports it.
+func (s *grpcServer) read(l CommitLog, offset uint64, rec *api.Record) (*api.Record, error) {
+	if r, ok := l.(recordReader); ok {
+		if err := r.ReadInto(offset, rec); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+	return l.Read(offset)
+}
+
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
 	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, produceAction); err != nil {
 		return nil, err
 	}
 
-	offset, err := s.CommitLog.Append(req.Record)
+	l, err := s.log(req.Log)
+	if err != nil {
+		return nil, err
+	}
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing record")
+	}
+	if req.Record.Type != api.RecordType_DATA || req.Record.TxnId != 0 {
+		return nil, status.Error(codes.InvalidArgument, "transaction markers and IDs are set by the server")
+	}
+	if req.ProducerId != 0 {
+		req.Record.ProducerId = req.ProducerId
+		req.Record.Sequence = req.Sequence
+	}
+	var offset uint64
+	if req.TxnId == 0 {
+		offset, err = s.append(l, req)
+	} else {
+		if s.Txns == nil {
+			return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+		}
+		err = s.Txns.Write(req.TxnId, req.Log, func() (err error) {
+			req.Record.TxnId = req.TxnId
+			offset, err = s.append(l, req)
+			return err
+		})
+	}
 	if err != nil {
 		return nil, err
 	}
+	// Consumer groups fall behind as records are produced, commits or not
+	s.refreshLag()
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+// append appends the request's record to l, at its expected offset or version
+// if it has one.
+func (s *grpcServer) append(l CommitLog, req *api.ProduceRequest) (uint64, error) {
+	switch {
+	case req.ExpectedOffset != nil && req.ExpectedVersion != nil:
+		return 0, status.Error(codes.InvalidArgument, "expected_offset and expected_version are exclusive")
+	case req.ExpectedOffset != nil:
+		a, ok := l.(conditionalAppender)
+		if !ok {
+			return 0, status.Error(codes.Unimplemented, "commit log doesn't support conditional appends")
+		}
+		return a.AppendAt(*req.ExpectedOffset, req.Record)
+	case req.ExpectedVersion != nil:
+		if req.Record.GetKey() == "" {
+			return 0, status.Error(codes.InvalidArgument, "expected_version needs a record key")
+		}
+		a, ok := l.(streamIndexer)
+		if !ok {
+			return 0, status.Error(codes.Unimplemented, "commit log doesn't index streams")
+		}
+		return a.AppendVersion(*req.ExpectedVersion, req.Record)
+	}
+	return l.Append(req.Record)
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -172,6 +557,440 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
+func (s *grpcServer) GetCorruptRanges(ctx context.Context, req *api.GetCorruptRangesRequest) (*api.GetCorruptRangesResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, adminAction); err != nil {
+		return nil, err
+	}
+
+	l, err := s.log(req.Log)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := l.(corruptionReporter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log isn't scrubbed")
+	}
+	return &api.GetCorruptRangesResponse{Ranges: r.CorruptRanges()}, nil
+}
+
+func (s *grpcServer) InitProducer(ctx context.Context, req *api.InitProducerRequest) (*api.InitProducerResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, produceAction); err != nil {
+		return nil, err
+	}
+
+	l, err := s.log(req.Log)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := l.(producerRegistry)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log doesn't deduplicate producers")
+	}
+	id, err := r.InitProducer()
+	if err != nil {
+		return nil, err
+	}
+	return &api.InitProducerResponse{ProducerId: id}, nil
+}
+
+// ReadStream sends the records with the request's key from its version onwards
+// and returns once it reaches the newest one.
+func (s *grpcServer) ReadStream(req *api.ReadStreamRequest, stream api.Log_ReadStreamServer) error {
+	if err := s.Authorizer.Authorize(stream.Context().Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return err
+	}
+
+	l, err := s.log(req.Log)
+	if err != nil {
+		return err
+	}
+	idx, ok := l.(streamIndexer)
+	if !ok {
+		return status.Error(codes.Unimplemented, "commit log doesn't index streams")
+	}
+	offsets, err := idx.StreamOffsets(req.Key, req.FromVersion)
+	if err != nil {
+		return err
+	}
+	res := &api.ReadStreamResponse{}
+	rec := &api.Record{}
+	for _, offset := range offsets {
+		res.Record, err = s.read(l, offset, rec)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			// Truncated since the offsets were looked up
+			continue
+		default:
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *grpcServer) BeginTxn(ctx context.Context, req *api.BeginTxnRequest) (*api.BeginTxnResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, produceAction); err != nil {
+		return nil, err
+	}
+
+	if s.Txns == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	id, err := s.Txns.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTxnResponse{TxnId: id}, nil
+}
+
+func (s *grpcServer) CommitTxn(ctx context.Context, req *api.CommitTxnRequest) (*api.CommitTxnResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, produceAction); err != nil {
+		return nil, err
+	}
+
+	if s.Txns == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	if err := s.Txns.Commit(req.TxnId); err != nil {
+		return nil, err
+	}
+	return &api.CommitTxnResponse{}, nil
+}
+
+func (s *grpcServer) AbortTxn(ctx context.Context, req *api.AbortTxnRequest) (*api.AbortTxnResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, produceAction); err != nil {
+		return nil, err
+	}
+
+	if s.Txns == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	if err := s.Txns.Abort(req.TxnId); err != nil {
+		return nil, err
+	}
+	return &api.AbortTxnResponse{}, nil
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	key, err := s.offsetKey(req.Group, req.Log, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if s.Groups != nil {
+		if err = s.Groups.Validate(req.Group, req.MemberId, req.Generation); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.Offsets.Commit(key, req.Offset); err != nil {
+		return nil, err
+	}
+	for _, p := range s.Offsets.Positions(req.Group) {
+		if p.OffsetKey == key {
+			// The commit stands even if the lag can't be measured
+			s.lag(ctx, p)
+		}
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchCommittedOffset(ctx context.Context, req *api.FetchCommittedOffsetRequest) (*api.FetchCommittedOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	key, err := s.offsetKey(req.Group, req.Log, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	res := &api.FetchCommittedOffsetResponse{}
+	if offset, ok := s.Offsets.Fetch(key); ok {
+		res.Offset = &offset
+	}
+	return res, nil
+}
+
+// offsetKey validates a consumer group offset request's fields.
+func (s *grpcServer) offsetKey(group, name string, partition uint32) (log.OffsetKey, error) {
+	if s.Offsets == nil {
+		return log.OffsetKey{}, status.Error(codes.Unimplemented, "consumer groups aren't enabled")
+	}
+	if group == "" {
+		return log.OffsetKey{}, status.Error(codes.InvalidArgument, "missing group")
+	}
+	if _, err := s.log(name); err != nil {
+		return log.OffsetKey{}, err
+	}
+	if partition != 0 {
+		return log.OffsetKey{}, status.Errorf(codes.NotFound, "unknown partition: %d", partition)
+	}
+	return log.OffsetKey{Group: group, Log: name, Partition: partition}, nil
+}
+
+func (s *grpcServer) JoinGroup(ctx context.Context, req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	if s.Groups == nil {
+		return nil, status.Error(codes.Unimplemented, "group coordination isn't enabled")
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing group")
+	}
+	for _, name := range req.Logs {
+		if _, err := s.log(name); err != nil {
+			return nil, err
+		}
+	}
+	m, err := s.Groups.Join(
+		req.Group,
+		req.MemberId,
+		req.Logs,
+		group.Strategy(req.Strategy),
+		time.Duration(req.SessionTimeoutMs)*time.Millisecond,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &api.JoinGroupResponse{
+		MemberId:    m.MemberID,
+		Generation:  m.Generation,
+		Assignments: assignments(m),
+	}, nil
+}
+
+func (s *grpcServer) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	if s.Groups == nil {
+		return nil, status.Error(codes.Unimplemented, "group coordination isn't enabled")
+	}
+	m, err := s.Groups.Heartbeat(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.HeartbeatResponse{
+		Generation:  m.Generation,
+		Assignments: assignments(m),
+	}, nil
+}
+
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *api.LeaveGroupRequest) (*api.LeaveGroupResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	if s.Groups == nil {
+		return nil, status.Error(codes.Unimplemented, "group coordination isn't enabled")
+	}
+	if err := s.Groups.Leave(req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
+
+func (s *grpcServer) DescribeGroup(ctx context.Context, req *api.DescribeGroupRequest) (*api.DescribeGroupResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups aren't enabled")
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing group")
+	}
+	res := &api.DescribeGroupResponse{}
+	if s.Groups != nil {
+		for _, m := range s.Groups.Describe(req.Group) {
+			res.Generation = m.Generation
+			res.Members = append(res.Members, &api.GroupMember{
+				MemberId:    m.MemberID,
+				Assignments: assignments(m),
+			})
+		}
+	}
+	var err error
+	res.Lags, err = s.lags(ctx, req.Group)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *grpcServer) GetLag(ctx context.Context, req *api.GetLagRequest) (*api.GetLagResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups aren't enabled")
+	}
+	lags, err := s.lags(ctx, req.Group)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetLagResponse{Lags: lags}, nil
+}
+
+// lags measures the lag of the group's positions, or of every group's if it's
+// empty.
+func (s *grpcServer) lags(ctx context.Context, group string) ([]*api.PartitionLag, error) {
+	var lags []*api.PartitionLag
+	for _, p := range s.Offsets.Positions(group) {
+		lag, err := s.lag(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		lags = append(lags, lag)
+	}
+	return lags, nil
+}
+
+// lag measures how far the position is behind the end of its log and records
+// it in the lag views.
+func (s *grpcServer) lag(ctx context.Context, p log.Position) (*api.PartitionLag, error) {
+	l, err := s.log(p.Log)
+	if err != nil {
+		return nil, err
+	}
+	_, end, err := bounds(l)
+	if err != nil {
+		return nil, err
+	}
+	var highest uint64
+	if end > 0 {
+		highest = end - 1
+	}
+	lag := &api.PartitionLag{
+		Group:           p.Group,
+		Log:             p.Log,
+		Partition:       p.Partition,
+		CommittedOffset: p.Offset,
+		HighestOffset:   highest,
+	}
+	if end > p.Offset {
+		lag.Lag = end - p.Offset
+	}
+	measurements := []stats.Measurement{
+		committedOffset.M(int64(p.Offset)),
+		highestOffset.M(int64(highest)),
+		lagRecords.M(int64(lag.Lag)),
+	}
+	if p.Rate > 0 {
+		seconds := float64(lag.Lag) / p.Rate
+		lag.LagSeconds = &seconds
+		measurements = append(measurements, lagSeconds.M(seconds))
+	}
+	err = stats.RecordWithTags(ctx, []tag.Mutator{
+		tag.Upsert(keyGroup, p.Group),
+		tag.Upsert(keyLog, p.Log),
+	}, measurements...)
+	if err != nil {
+		return nil, err
+	}
+	return lag, nil
+}
+
+// refreshLag records the lag of every group's positions, unless it was
+// recorded within lagInterval.
+func (s *grpcServer) refreshLag() {
+	if s.Offsets == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := s.lagRecordedAt.Load()
+	if now-last < int64(lagInterval) || !s.lagRecordedAt.CompareAndSwap(last, now) {
+		return
+	}
+	for _, p := range s.Offsets.Positions("") {
+		// A log that can't be measured doesn't hold up the others
+		s.lag(context.Background(), p)
+	}
+}
+
+func (s *grpcServer) Receive(ctx context.Context, req *api.ReceiveRequest) (*api.ReceiveResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSubscription(req.Subscription, req.Log); err != nil {
+		return nil, err
+	}
+	max := int(req.MaxRecords)
+	if max == 0 {
+		max = 1
+	}
+	deliveries, err := s.Queues.Receive(req.Subscription, req.Log, max)
+	if err != nil {
+		return nil, queueError(err)
+	}
+	res := &api.ReceiveResponse{}
+	for _, d := range deliveries {
+		res.Deliveries = append(res.Deliveries, &api.Delivery{
+			Record:  d.Record,
+			Attempt: d.Attempt,
+		})
+	}
+	return res, nil
+}
+
+func (s *grpcServer) Ack(ctx context.Context, req *api.AckRequest) (*api.AckResponse, error) {
+	if err := s.Authorizer.Authorize(ctx.Value(subjectContextKey{}).(string), wildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSubscription(req.Subscription, req.Log); err != nil {
+		return nil, err
+	}
+	for _, offset := range req.Offsets {
+		if err := s.Queues.Ack(req.Subscription, req.Log, offset); err != nil {
+			return nil, queueError(err)
+		}
+	}
+	return &api.AckResponse{}, nil
+}
+
+// checkSubscription validates a shared subscription request's fields.
+func (s *grpcServer) checkSubscription(name, log string) error {
+	if s.Queues == nil {
+		return status.Error(codes.Unimplemented, "shared subscriptions aren't enabled")
+	}
+	if name == "" {
+		return status.Error(codes.InvalidArgument, "missing subscription")
+	}
+	_, err := s.log(log)
+	return err
+}
+
+// queueError gives the queue's errors their status codes.
+func queueError(err error) error {
+	switch {
+	case errors.Is(err, queue.ErrNotDelivered):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, queue.ErrLogMismatch):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return err
+}
+
+func assignments(m group.Membership) []*api.Assignment {
+	var as []*api.Assignment
+	for _, p := range m.Partitions {
+		as = append(as, &api.Assignment{Log: p.Log, Partition: p.Partition})
+	}
+	return as
+}
+
 func authenticate(ctx context.Context) (context.Context, error) {
 	peer, ok := peer.FromContext()
 	if !ok {
@@ -0,0 +1,188 @@
+package txn
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+	"github.com/alphaleph/yojimbo/internal/log"
+)
+
+func TestCoordinator(t *testing.T) {
+	dir, err := os.MkdirTemp("", "txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a, b := log.NewMemoryLog(log.Config{}), log.NewMemoryLog(log.Config{})
+	logs := map[string]Participant{"a": a, "b": b}
+	c, err := NewCoordinator(dir, logs, Config{})
+	require.NoError(t, err)
+
+	id, err := c.Begin()
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "a"} {
+		l := logs[name]
+		require.NoError(t, c.Write(id, name, func() error {
+			_, err := l.Append(&api.Record{TxnId: id})
+			return err
+		}))
+	}
+	_, err = a.ReadCommitted(0)
+	require.True(t, errors.As(err, &api.ErrOffsetOutOfRange{}), "got %v", err)
+
+	require.NoError(t, c.Commit(id))
+	rec, err := a.ReadCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, id, rec.TxnId)
+	// Both records in a, then the marker
+	marker, err := a.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, api.RecordType_COMMIT, marker.Type)
+	marker, err = b.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, api.RecordType_COMMIT, marker.Type)
+
+	err = c.Abort(id)
+	require.True(t, errors.As(err, &api.ErrUnknownTxn{}), "got %v", err)
+	err = c.Write(id, "a", func() error { return nil })
+	require.True(t, errors.As(err, &api.ErrUnknownTxn{}), "got %v", err)
+	require.NoError(t, c.Close())
+}
+
+func TestCoordinatorRecover(t *testing.T) {
+	dir, err := os.MkdirTemp("", "txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := log.NewMemoryLog(log.Config{})
+	logs := map[string]Participant{"a": a}
+	c, err := NewCoordinator(dir, logs, Config{})
+	require.NoError(t, err)
+	open, err := c.Begin()
+	require.NoError(t, err)
+	decided, err := c.Begin()
+	require.NoError(t, err)
+	for _, id := range []uint64{open, decided} {
+		id := id
+		require.NoError(t, c.Write(id, "a", func() error {
+			_, err := a.Append(&api.Record{TxnId: id})
+			return err
+		}))
+	}
+	// Decide the second transaction without writing its marker, as if the
+	// coordinator crashed part way through committing it
+	c.mu.Lock()
+	_, err = c.log(entry{ID: decided, State: stateCommit})
+	c.mu.Unlock()
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	c, err = NewCoordinator(dir, logs, Config{})
+	require.NoError(t, err)
+	marker, err := a.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, decided, marker.TxnId)
+	require.Equal(t, api.RecordType_COMMIT, marker.Type)
+	// The open transaction is still open
+	require.NoError(t, c.Abort(open))
+	require.NoError(t, c.Close())
+}
+
+func TestCoordinatorTimeout(t *testing.T) {
+	dir, err := os.MkdirTemp("", "txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := log.NewMemoryLog(log.Config{})
+	c, err := NewCoordinator(dir, map[string]Participant{"a": a}, Config{
+		Timeout: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	id, err := c.Begin()
+	require.NoError(t, err)
+	require.NoError(t, c.Write(id, "a", func() error {
+		_, err := a.Append(&api.Record{TxnId: id})
+		return err
+	}))
+	require.Eventually(t, func() bool {
+		rec, err := a.Read(1)
+		return err == nil && rec.Type == api.RecordType_ABORT
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, c.Close())
+}
+
+func TestCoordinatorCrash(t *testing.T) {
+	dir, err := os.MkdirTemp("", "txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := log.NewMemoryLog(log.Config{})
+	failing := &failingMarkers{Participant: a}
+	crashed, err := NewCoordinator(dir, map[string]Participant{"a": failing}, Config{})
+	require.NoError(t, err)
+	id, err := crashed.Begin()
+	require.NoError(t, err)
+	require.NoError(t, crashed.Write(id, "a", func() error {
+		_, err := a.Append(&api.Record{TxnId: id})
+		return err
+	}))
+	require.Error(t, crashed.Commit(id))
+
+	// Open the log again without closing it, as if the coordinator crashed
+	// before writing the marker, so only what was synced is read back
+	c, err := NewCoordinator(dir, map[string]Participant{"a": a}, Config{})
+	require.NoError(t, err)
+	marker, err := a.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, id, marker.TxnId)
+	require.Equal(t, api.RecordType_COMMIT, marker.Type)
+	next, err := c.Begin()
+	require.NoError(t, err)
+	require.Greater(t, next, id)
+	require.NoError(t, c.Close())
+	close(crashed.done)
+	crashed.wg.Wait()
+}
+
+// failingMarkers fails to append transaction markers.
+type failingMarkers struct {
+	Participant
+}
+
+func (f *failingMarkers) Append(rec *api.Record) (uint64, error) {
+	if rec.Type != api.RecordType_DATA {
+		return 0, errors.New("failing markers")
+	}
+	return f.Participant.Append(rec)
+}
+
+func TestCoordinatorDefaultTimeout(t *testing.T) {
+	dir, err := os.MkdirTemp("", "txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := log.NewMemoryLog(log.Config{})
+	c, err := NewCoordinator(dir, map[string]Participant{"a": a}, Config{})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, time.Minute, c.Config.Timeout)
+	id, err := c.Begin()
+	require.NoError(t, err)
+	require.NoError(t, c.Write(id, "a", func() error {
+		_, err := a.Append(&api.Record{TxnId: id})
+		return err
+	}))
+
+	// An abandoned transaction is aborted once the timeout passes
+	c.abortExpired(time.Now().Add(time.Minute / 2))
+	_, err = a.Read(1)
+	require.Error(t, err)
+	c.abortExpired(time.Now().Add(time.Minute))
+	rec, err := a.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, api.RecordType_ABORT, rec.Type)
+}
@@ -0,0 +1,353 @@
+// Package txn coordinates transactions whose records span several logs. Each
+// participating log gets a COMMIT or ABORT marker once the transaction ends,
+// which read-committed readers use to decide whether its records are visible.
+package txn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+	"github.com/alphaleph/yojimbo/internal/log"
+)
+
+// Participant is a log transactions write to.
+type Participant interface {
+	Append(*api.Record) (uint64, error)
+}
+
+type Config struct {
+	// Timeout aborts transactions that haven't been written to for this
+	// long, so that abandoned ones don't hold read-committed readers back
+	// forever. Defaults to a minute.
+	Timeout time.Duration
+}
+
+// The states a transaction goes through in the coordinator's log. Once commit
+// or abort is logged the transaction's outcome is decided, and done is logged
+// after every participant has its marker.
+const (
+	stateBegin  = "begin"
+	stateJoin   = "join"
+	stateCommit = "commit"
+	stateAbort  = "abort"
+	stateDone   = "done"
+)
+
+// entry is a record in the coordinator's log.
+type entry struct {
+	// ID is the transaction's ID, which is the offset of its begin entry
+	// plus one, so begin entries leave it unset.
+	ID    uint64 `json:"id,omitempty"`
+	State string `json:"state"`
+	Log   string `json:"log,omitempty"`
+}
+
+type txn struct {
+	// mu is held shared while writing to the transaction, so ending it
+	// waits for the writes in flight and no record lands after a marker.
+	mu sync.RWMutex
+	// logs are the participants written to so far and decision is the
+	// logged outcome, if any. Both are guarded by the coordinator's mu.
+	logs     []string
+	decision string
+	touched  time.Time
+}
+
+// Coordinator begins and ends transactions, keeping their state in a log of
+// its own so that transactions survive a restart and decided ones are
+// finished.
+type Coordinator struct {
+	mu     sync.Mutex
+	Config Config
+	state  *log.Log
+	logs   map[string]Participant
+	txns   map[uint64]*txn
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewCoordinator opens the coordinator's log in dir and finishes the
+// transactions that were decided before it was last closed. Transactions that
+// were still open stay open until they time out. logs are the participants by
+// name.
+func NewCoordinator(dir string, logs map[string]Participant, c Config) (*Coordinator, error) {
+	if c.Timeout == 0 {
+		c.Timeout = time.Minute
+	}
+	state, err := log.NewLog(dir, log.Config{})
+	if err != nil {
+		return nil, err
+	}
+	co := &Coordinator{
+		Config: c,
+		state:  state,
+		logs:   logs,
+		txns:   make(map[uint64]*txn),
+		done:   make(chan struct{}),
+	}
+	if err = co.recover(); err != nil {
+		state.Close()
+		return nil, err
+	}
+	co.start()
+	return co, nil
+}
+
+func (c *Coordinator) recover() error {
+	offset, err := c.state.LowestOffset()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for ; ; offset++ {
+		rec, err := c.state.Read(offset)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var e entry
+		if err = json.Unmarshal(rec.Value, &e); err != nil {
+			return err
+		}
+		if e.State == stateBegin {
+			c.txns[offset+1] = &txn{touched: now}
+			continue
+		}
+		t, ok := c.txns[e.ID]
+		if !ok {
+			continue
+		}
+		switch e.State {
+		case stateJoin:
+			t.logs = append(t.logs, e.Log)
+		case stateCommit, stateAbort:
+			t.decision = e.State
+		case stateDone:
+			delete(c.txns, e.ID)
+		}
+	}
+	for id, t := range c.txns {
+		if t.decision == "" {
+			continue
+		}
+		if err := c.end(id, t.decision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start aborts transactions that time out until the coordinator is closed.
+func (c *Coordinator) start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.Config.Timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case now := <-ticker.C:
+				c.abortExpired(now)
+			}
+		}
+	}()
+}
+
+func (c *Coordinator) abortExpired(now time.Time) {
+	c.mu.Lock()
+	var expired []uint64
+	for id, t := range c.txns {
+		if t.decision == "" && now.Sub(t.touched) >= c.Config.Timeout {
+			expired = append(expired, id)
+		}
+	}
+	c.mu.Unlock()
+	for _, id := range expired {
+		err := c.Abort(id)
+		if err != nil && !errors.As(err, &api.ErrUnknownTxn{}) {
+			zap.L().Named("txn").Error(
+				"failed to abort expired transaction",
+				zap.Uint64("txn_id", id),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// Begin starts a transaction and returns its ID.
+func (c *Coordinator) Begin() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offset, err := c.log(entry{State: stateBegin})
+	if err != nil {
+		return 0, err
+	}
+	id := offset + 1
+	c.txns[id] = &txn{touched: time.Now()}
+	return id, nil
+}
+
+// Write runs write, which appends records of transaction id to the named log.
+// The log is recorded as a participant first, so it gets a marker however the
+// transaction ends.
+func (c *Coordinator) Write(id uint64, name string, write func() error) error {
+	if _, ok := c.logs[name]; !ok {
+		return fmt.Errorf("unknown log: %q", name)
+	}
+	t, err := c.join(id, name)
+	if err != nil {
+		return err
+	}
+	defer t.mu.RUnlock()
+	return write()
+}
+
+// join records name as a participant of transaction id and returns the
+// transaction held shared.
+func (c *Coordinator) join(id uint64, name string) (*txn, error) {
+	c.mu.Lock()
+	t, ok := c.txns[id]
+	c.mu.Unlock()
+	if !ok {
+		return nil, api.ErrUnknownTxn{TxnID: id}
+	}
+	t.mu.RLock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.decision != "" {
+		t.mu.RUnlock()
+		return nil, api.ErrUnknownTxn{TxnID: id}
+	}
+	t.touched = time.Now()
+	for _, l := range t.logs {
+		if l == name {
+			return t, nil
+		}
+	}
+	if _, err := c.log(entry{ID: id, State: stateJoin, Log: name}); err != nil {
+		t.mu.RUnlock()
+		return nil, err
+	}
+	t.logs = append(t.logs, name)
+	return t, nil
+}
+
+// Commit makes transaction id's records visible to read-committed readers.
+func (c *Coordinator) Commit(id uint64) error {
+	return c.end(id, stateCommit)
+}
+
+// Abort hides transaction id's records from read-committed readers.
+func (c *Coordinator) Abort(id uint64) error {
+	return c.end(id, stateAbort)
+}
+
+// end logs the transaction's outcome and writes its markers. If writing a
+// marker fails the outcome stands, and ending it the same way again retries.
+func (c *Coordinator) end(id uint64, decision string) error {
+	c.mu.Lock()
+	t, ok := c.txns[id]
+	c.mu.Unlock()
+	if !ok {
+		return api.ErrUnknownTxn{TxnID: id}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c.mu.Lock()
+	if c.txns[id] != t {
+		// Ended while we waited
+		c.mu.Unlock()
+		return api.ErrUnknownTxn{TxnID: id}
+	}
+	if t.decision == "" {
+		if _, err := c.log(entry{ID: id, State: decision}); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		t.decision = decision
+	}
+	logs := t.logs
+	c.mu.Unlock()
+	if t.decision != decision {
+		return api.ErrUnknownTxn{TxnID: id}
+	}
+
+	typ := api.RecordType_COMMIT
+	if decision == stateAbort {
+		typ = api.RecordType_ABORT
+	}
+	for _, name := range logs {
+		l, ok := c.logs[name]
+		if !ok {
+			return fmt.Errorf("unknown log: %q", name)
+		}
+		if _, err := l.Append(&api.Record{TxnId: id, Type: typ}); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.log(entry{ID: id, State: stateDone}); err != nil {
+		return err
+	}
+	delete(c.txns, id)
+	return c.compact()
+}
+
+// log appends e to the coordinator's log. Entries other than done are synced
+// before anything is written on the strength of them: a lost begin entry would
+// hand its ID out again and a lost decision would leave markers behind for a
+// transaction the coordinator no longer knows about. A lost done entry only
+// repeats the markers, which participants ignore. The caller must hold c.mu.
+func (c *Coordinator) log(e entry) (uint64, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := c.state.Append(&api.Record{Value: b})
+	if err != nil || e.State == stateDone {
+		return offset, err
+	}
+	return offset, c.state.Sync()
+}
+
+// compact truncates the coordinator's log up to the oldest transaction that
+// hasn't ended. The caller must hold c.mu.
+func (c *Coordinator) compact() error {
+	highest, err := c.state.HighestOffset()
+	if err != nil {
+		return err
+	}
+	keep := highest + 1
+	for id := range c.txns {
+		// The transaction's begin entry is at id-1
+		if id-1 < keep {
+			keep = id - 1
+		}
+	}
+	if keep == 0 {
+		return nil
+	}
+	return c.state.Truncate(keep - 1)
+}
+
+// Close stops aborting transactions that time out and closes the
+// coordinator's log. Open transactions stay open.
+func (c *Coordinator) Close() error {
+	close(c.done)
+	c.wg.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.Close()
+}
@@ -0,0 +1,187 @@
+package log
+
+import (
+	"time"
+
+	"github.com/alphaleph/yojimbo/internal/log"
+)
+
+// Placement picks the directory each new segment is created in.
+type Placement int
+
+const (
+	// RoundRobin cycles through the online directories.
+	RoundRobin Placement = iota
+	// MostFree picks the online directory with the most free space.
+	MostFree
+)
+
+// Config configures a Log. The zero value is a usable config and every field
+// left zero takes its default.
+type Config struct {
+	// MaxSegmentBytes is the size a segment's records grow to before the
+	// log rolls to a new segment. Defaults to 1KiB.
+	MaxSegmentBytes uint64
+	// MaxSegmentRecords is the number of records a segment holds before
+	// the log rolls to a new segment. Defaults to 85.
+	MaxSegmentRecords uint64
+	// InitialOffset is the offset of a new log's first record.
+	InitialOffset uint64
+	// MaxSegmentAge rolls a segment once it's been written to for this
+	// long, so that old records can be truncated. Zero disables it.
+	MaxSegmentAge time.Duration
+	// MmapSealed reads older segments through a memory mapping, so that
+	// concurrent readers of them don't contend on a lock.
+	MmapSealed bool
+	// MaxOpenSegments bounds how many older segments are kept open for
+	// reading at once. Zero means no limit.
+	MaxOpenSegments int
+	// CheckpointInterval is how often the log is synced to disk. Zero
+	// only syncs when rolling to a new segment and on Close. Opening the
+	// log reads the records written since the last sync, or every record
+	// if its checkpoint file was lost.
+	CheckpointInterval time.Duration
+	// MergeInterval is how often runs of small segments are merged. Zero
+	// disables merging.
+	MergeInterval time.Duration
+	// ScrubInterval is how often the next older segment is re-read to check
+	// for corruption. Zero disables scrubbing.
+	ScrubInterval time.Duration
+	// ReadAheadBytes is how far ahead of sequential readers older
+	// segments are prefetched. Zero disables read-ahead.
+	ReadAheadBytes uint64
+	// CacheBytes is the size of the recently appended records kept in
+	// memory for tailing readers. Zero disables the cache.
+	CacheBytes uint64
+	// MaxBytes bounds the size of the log's records on disk, past which
+	// Append returns ErrQuotaExceeded. Zero means no limit.
+	MaxBytes uint64
+	// MinFreeBytes is the free disk space Append leaves. Zero means no
+	// floor.
+	MinFreeBytes uint64
+	// Dirs are extra directories, e.g. on other disks, that segments are
+	// spread across along with the log's own. Each must only be used by
+	// this log.
+	Dirs []string
+	// Placement picks the directory for each new segment.
+	Placement Placement
+}
+
+func (c Config) internal() log.Config {
+	var ic log.Config
+	ic.Segment.MaxStoreBytes = c.MaxSegmentBytes
+	ic.Segment.MaxIndexBytes = log.IndexBytes(c.MaxSegmentRecords)
+	ic.Segment.InitialOffset = c.InitialOffset
+	ic.Segment.MaxAge = c.MaxSegmentAge
+	ic.Segment.MmapSealed = c.MmapSealed
+	ic.Segment.MaxOpenSegments = c.MaxOpenSegments
+	ic.Checkpoint.Interval = c.CheckpointInterval
+	ic.Merge.Interval = c.MergeInterval
+	ic.Scrub.Interval = c.ScrubInterval
+	ic.ReadAhead.Bytes = c.ReadAheadBytes
+	ic.Cache.MaxBytes = c.CacheBytes
+	ic.Quota.MaxBytes = c.MaxBytes
+	ic.Quota.MinFreeBytes = c.MinFreeBytes
+	ic.Storage.Dirs = c.Dirs
+	ic.Storage.Placement = log.Placement(c.Placement)
+	return ic
+}
+
+// Option configures a Log opened with Open.
+type Option func(*Config)
+
+// WithConfig replaces the whole config. Options after it still apply.
+func WithConfig(c Config) Option {
+	return func(cfg *Config) {
+		*cfg = c
+	}
+}
+
+// WithSegmentSize rolls to a new segment once the current one holds maxBytes
+// or maxRecords, whichever comes first.
+func WithSegmentSize(maxBytes, maxRecords uint64) Option {
+	return func(c *Config) {
+		c.MaxSegmentBytes = maxBytes
+		c.MaxSegmentRecords = maxRecords
+	}
+}
+
+// WithInitialOffset sets the offset of a new log's first record.
+func WithInitialOffset(offset uint64) Option {
+	return func(c *Config) {
+		c.InitialOffset = offset
+	}
+}
+
+// WithMaxSegmentAge rolls segments once they've been written to for d.
+func WithMaxSegmentAge(d time.Duration) Option {
+	return func(c *Config) {
+		c.MaxSegmentAge = d
+	}
+}
+
+// WithMmap reads older segments through a memory mapping.
+func WithMmap() Option {
+	return func(c *Config) {
+		c.MmapSealed = true
+	}
+}
+
+// WithMaxOpenSegments bounds how many older segments are kept open at once.
+func WithMaxOpenSegments(n int) Option {
+	return func(c *Config) {
+		c.MaxOpenSegments = n
+	}
+}
+
+// WithCheckpointInterval syncs the log to disk every d.
+func WithCheckpointInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.CheckpointInterval = d
+	}
+}
+
+// WithMergeInterval merges runs of small segments every d.
+func WithMergeInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.MergeInterval = d
+	}
+}
+
+// WithScrubInterval checks the next older segment for corruption every d.
+func WithScrubInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.ScrubInterval = d
+	}
+}
+
+// WithReadAhead prefetches n bytes ahead of sequential readers.
+func WithReadAhead(n uint64) Option {
+	return func(c *Config) {
+		c.ReadAheadBytes = n
+	}
+}
+
+// WithCache keeps up to maxBytes of recently appended records in memory.
+func WithCache(maxBytes uint64) Option {
+	return func(c *Config) {
+		c.CacheBytes = maxBytes
+	}
+}
+
+// WithQuota refuses appends past maxBytes of records or below minFreeBytes of
+// free disk space.
+func WithQuota(maxBytes, minFreeBytes uint64) Option {
+	return func(c *Config) {
+		c.MaxBytes = maxBytes
+		c.MinFreeBytes = minFreeBytes
+	}
+}
+
+// WithDirs spreads segments across dirs as well as the log's own directory.
+func WithDirs(placement Placement, dirs ...string) Option {
+	return func(c *Config) {
+		c.Placement = placement
+		c.Dirs = dirs
+	}
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+	"github.com/alphaleph/yojimbo/pkg/log/logtest"
+)
+
+func TestConformance(t *testing.T) {
+	logtest.Run(t, logtest.Harness{
+		New: func(t *testing.T) logtest.CommitLog {
+			l, err := Open(tempDir(t), WithSegmentSize(64, 4))
+			require.NoError(t, err)
+			return l
+		},
+		Reopen: func(t *testing.T, cl logtest.CommitLog) logtest.CommitLog {
+			l := cl.(*Log)
+			require.NoError(t, l.Close())
+			l, err := Open(l.log.Dir, WithSegmentSize(64, 4))
+			require.NoError(t, err)
+			return l
+		},
+	})
+}
+
+func TestOptions(t *testing.T) {
+	dir := tempDir(t)
+	l, err := Open(
+		dir,
+		WithConfig(Config{MaxSegmentBytes: 1 << 20, CacheBytes: 1024}),
+		WithSegmentSize(0, 2),
+		WithInitialOffset(10),
+		WithMaxSegmentAge(time.Hour),
+		WithQuota(1<<20, 0),
+	)
+	require.NoError(t, err)
+	defer l.Close()
+
+	c := l.log.Config
+	require.Equal(t, uint64(1024), c.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(24), c.Segment.MaxIndexBytes)
+	require.Equal(t, uint64(1024), c.Cache.MaxBytes)
+	require.Equal(t, time.Hour, c.Segment.MaxAge)
+	require.Equal(t, uint64(1<<20), c.Quota.MaxBytes)
+
+	offset, err := l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), offset)
+}
+
+func TestIterator(t *testing.T) {
+	l, err := Open(tempDir(t), WithSegmentSize(0, 2))
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	it := l.Iterator(1)
+	var offsets []uint64
+	for it.Next() {
+		offsets = append(offsets, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []uint64{1, 2, 3, 4}, offsets)
+
+	// The iterator picks up records appended after it reached the end
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	require.Equal(t, uint64(5), it.Record().Offset)
+	require.Equal(t, uint64(6), it.Offset())
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	// but starting before the oldest record is an error
+	require.NoError(t, l.Truncate(1))
+	it = l.Iterator(0)
+	require.False(t, it.Next())
+	require.Equal(t, ErrOffsetOutOfRange{Offset: 0}, it.Err())
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
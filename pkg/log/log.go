@@ -0,0 +1,235 @@
+// Package log is an embeddable, durable commit log. It's the log the yojimbo
+// server is built on, packaged for services and tools that want a local
+// append-only queue without running a server.
+//
+// Records are api.Records from github.com/alphaleph/yojimbo/api/v1. Every
+// record appended is assigned the next offset and can be read back by it until
+// it's truncated.
+//
+// The package follows semantic versioning: Log, Config, Iterator and the
+// options won't change incompatibly within a major version.
+package log
+
+import (
+	"errors"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+	"github.com/alphaleph/yojimbo/internal/log"
+)
+
+// ErrOffsetOutOfRange is returned when reading an offset the log doesn't
+// hold.
+type ErrOffsetOutOfRange = api.ErrOffsetOutOfRange
+
+// ErrQuotaExceeded is returned when appending would go past the log's quota.
+type ErrQuotaExceeded = api.ErrQuotaExceeded
+
+// ErrUnknownProducer is returned when appending a record from a producer ID
+// the log didn't hand out or has since forgotten.
+type ErrUnknownProducer = api.ErrUnknownProducer
+
+// ErrOutOfOrderSequence is returned when appending a record whose sequence
+// number isn't the producer's next one or a recent one.
+type ErrOutOfOrderSequence = api.ErrOutOfOrderSequence
+
+// ErrUnexpectedOffset is returned by AppendAt when the log's next offset isn't
+// the expected one.
+type ErrUnexpectedOffset = api.ErrUnexpectedOffset
+
+// ErrUnexpectedVersion is returned by AppendVersion when the stream's next
+// version isn't the expected one.
+type ErrUnexpectedVersion = api.ErrUnexpectedVersion
+
+// ErrNoKey is returned by AppendVersion for a record without a key.
+var ErrNoKey = log.ErrNoKey
+
+// ErrDirOffline is returned when reading a record from a directory that went
+// offline after its disk failed.
+var ErrDirOffline = log.ErrDirOffline
+
+// Log is a durable commit log stored in a directory. It's safe for concurrent
+// use.
+type Log struct {
+	log *log.Log
+}
+
+// Open opens the log in dir, recovering whatever was written to it before, or
+// creates it if it doesn't exist.
+func Open(dir string, opts ...Option) (*Log, error) {
+	var c Config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	l, err := log.NewLog(dir, c.internal())
+	if err != nil {
+		return nil, err
+	}
+	return &Log{log: l}, nil
+}
+
+// Append appends rec at the next offset, sets rec.Offset and returns it.
+func (l *Log) Append(rec *api.Record) (uint64, error) {
+	return l.log.Append(rec)
+}
+
+// AppendAt appends rec only if it gets offset expected, that is if the log's
+// next offset is still expected. Otherwise it returns ErrUnexpectedOffset with
+// the actual next offset, so writers can detect concurrent appends without a
+// lock of their own.
+func (l *Log) AppendAt(expected uint64, rec *api.Record) (uint64, error) {
+	return l.log.AppendAt(expected, rec)
+}
+
+// AppendVersion appends rec only if it's the next version of the stream of
+// records with its key, that is if the stream's next version is still
+// expected. Otherwise it returns ErrUnexpectedVersion with the actual next
+// version. rec must have a key.
+func (l *Log) AppendVersion(expected uint64, rec *api.Record) (uint64, error) {
+	return l.log.AppendVersion(expected, rec)
+}
+
+// StreamOffsets returns the offsets of the records with key from version from
+// onwards, in order. Appending a record with a key sets its version, counting
+// from 0 for each key. Versions aren't reused once a key's records are
+// truncated.
+func (l *Log) StreamOffsets(key string, from uint64) ([]uint64, error) {
+	return l.log.StreamOffsets(key, from)
+}
+
+// ReadCommitted returns the first record at or after offset that's visible to
+// read-committed readers. Transaction markers and the records of aborted
+// transactions are skipped, and the records from the first one of a still open
+// transaction onwards are out of range until it ends.
+func (l *Log) ReadCommitted(offset uint64) (*api.Record, error) {
+	return l.log.ReadCommitted(offset)
+}
+
+// OffsetAt returns the offset of the first record appended at or after
+// timestamp, in Unix milliseconds, or the next offset if there's none. Appending
+// a record sets its timestamp.
+func (l *Log) OffsetAt(timestamp int64) (uint64, error) {
+	return l.log.OffsetAt(timestamp)
+}
+
+// InitProducer registers an idempotent producer and returns its ID. Records
+// appended with the ID and a sequence number starting from 0 are deduplicated:
+// appending a recent one again returns the offset it was first appended at,
+// and skipping ahead returns ErrOutOfOrderSequence. A producer is forgotten
+// once Truncate removes its latest record, after which its records fail with
+// ErrUnknownProducer.
+func (l *Log) InitProducer() (uint64, error) {
+	return l.log.InitProducer()
+}
+
+// Read returns the record at offset.
+func (l *Log) Read(offset uint64) (*api.Record, error) {
+	return l.log.Read(offset)
+}
+
+// ReadInto reads the record at offset into rec, reusing its memory.
+func (l *Log) ReadInto(offset uint64, rec *api.Record) error {
+	return l.log.ReadInto(offset, rec)
+}
+
+// LowestOffset returns the offset of the oldest record.
+func (l *Log) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+// HighestOffset returns the offset of the newest record.
+func (l *Log) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+// Truncate removes the records with offsets up to and including lowest. Whole
+// segments are removed, so records before lowest may remain readable.
+func (l *Log) Truncate(lowest uint64) error {
+	return l.log.Truncate(lowest)
+}
+
+// TruncateAfter removes every record with an offset greater than offset.
+func (l *Log) TruncateAfter(offset uint64) error {
+	return l.log.TruncateAfter(offset)
+}
+
+// CorruptRanges returns the ranges of offsets found corrupt by scrubbing.
+func (l *Log) CorruptRanges() []*api.OffsetRange {
+	return l.log.CorruptRanges()
+}
+
+// Close flushes the log to disk and closes it.
+func (l *Log) Close() error {
+	return l.log.Close()
+}
+
+// Remove closes the log and deletes its files.
+func (l *Log) Remove() error {
+	return l.log.Remove()
+}
+
+// Iterator returns an iterator over the log's records starting at offset.
+func (l *Log) Iterator(offset uint64) *Iterator {
+	return &Iterator{log: l, offset: offset}
+}
+
+// Iterator reads a log's records in offset order.
+//
+//	it := l.Iterator(0)
+//	for it.Next() {
+//		process(it.Record())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Next returns false once it reaches the end of the log. Calling it again
+// later picks up from there, so an iterator can be used to tail the log.
+type Iterator struct {
+	log    *Log
+	offset uint64
+	rec    *api.Record
+	err    error
+}
+
+// Next reads the next record and reports whether there was one.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	rec := &api.Record{}
+	err := it.log.ReadInto(it.offset, rec)
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		// Past the end we wait for more records, but records before the
+		// start are gone for good
+		lowest, lerr := it.log.LowestOffset()
+		if lerr != nil {
+			it.err = lerr
+		} else if it.offset < lowest {
+			it.err = err
+		}
+		return false
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.rec = rec
+	it.offset++
+	return true
+}
+
+// Record returns the record read by the last call to Next. It isn't reused,
+// so it can be kept after Next is called again.
+func (it *Iterator) Record() *api.Record {
+	return it.rec
+}
+
+// Offset returns the offset the next call to Next reads.
+func (it *Iterator) Offset() uint64 {
+	return it.offset
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
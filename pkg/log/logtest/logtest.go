@@ -0,0 +1,489 @@
+// Package logtest is a conformance suite for commit log implementations. It
+// checks the behaviour the server relies on, so that any backend passing it
+// can be swapped in for another. Backends outside this module run it from
+// their own tests by calling Run with a Harness that opens them.
+package logtest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/alphaleph/yojimbo/api/v1"
+)
+
+// CommitLog is the interface every implementation is checked against. It
+// matches the server's.
+type CommitLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+}
+
+// Truncater is implemented by logs that support removing their oldest records.
+// Truncate may keep more records than asked, e.g. to remove whole segments,
+// but never fewer.
+type Truncater interface {
+	Truncate(lowest uint64) error
+	LowestOffset() (uint64, error)
+}
+
+// TailTruncater is implemented by logs that support removing their newest
+// records.
+type TailTruncater interface {
+	TruncateAfter(offset uint64) error
+	HighestOffset() (uint64, error)
+}
+
+// IdempotentLog is implemented by logs that deduplicate records from
+// registered producers.
+type IdempotentLog interface {
+	InitProducer() (uint64, error)
+}
+
+// ConditionalLog is implemented by logs that can append a record only at an
+// expected offset.
+type ConditionalLog interface {
+	AppendAt(expected uint64, rec *api.Record) (uint64, error)
+}
+
+// StreamLog is implemented by logs that index records by key.
+type StreamLog interface {
+	AppendVersion(expected uint64, rec *api.Record) (uint64, error)
+	StreamOffsets(key string, from uint64) ([]uint64, error)
+}
+
+// CommittedReader is implemented by logs that can hide uncommitted
+// transactional records.
+type CommittedReader interface {
+	ReadCommitted(offset uint64) (*api.Record, error)
+}
+
+// TimestampLog is implemented by logs that can look records up by the time
+// they were appended.
+type TimestampLog interface {
+	OffsetAt(timestamp int64) (uint64, error)
+}
+
+// Harness opens the logs under test.
+type Harness struct {
+	// New returns a new empty log. It's closed by the test if it has a
+	// Close method.
+	New func(t *testing.T) CommitLog
+	// Reopen closes l and opens it again from whatever it persisted. Leave
+	// it nil for logs that don't survive a restart.
+	Reopen func(t *testing.T, l CommitLog) CommitLog
+}
+
+// Run runs the conformance suite against the logs h opens. Tests for optional
+// behaviour are skipped when the log doesn't implement it.
+func Run(t *testing.T, h Harness) {
+	for scenario, fn := range map[string]func(t *testing.T, h Harness, l CommitLog){
+		"offsets are assigned in order": testOffsets,
+		"records read back in order":    testReadBack,
+		"offset out of range error":     testOutOfRange,
+		"concurrent append and read":    testConcurrent,
+		"restart durability":            testRestart,
+		"truncate":                      testTruncate,
+		"truncate after":                testTruncateAfter,
+		"idempotent producer":           testIdempotentProducer,
+		"conditional append":            testConditionalAppend,
+		"streams":                       testStreams,
+		"read committed":                testReadCommitted,
+		"timestamps":                    testTimestamps,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			l := h.New(t)
+			fn(t, h, l)
+		})
+	}
+}
+
+func testOffsets(t *testing.T, _ Harness, l CommitLog) {
+	first := appendN(t, l, 1)
+	for i := uint64(1); i < 10; i++ {
+		require.Equal(t, first+i, appendN(t, l, 1))
+	}
+	closeLog(t, l)
+}
+
+func testReadBack(t *testing.T, _ Harness, l CommitLog) {
+	first := appendN(t, l, 10)
+	requireRecords(t, l, first, first, first+10)
+	closeLog(t, l)
+}
+
+func testOutOfRange(t *testing.T, _ Harness, l CommitLog) {
+	first := appendN(t, l, 3)
+	read, err := l.Read(first + 3)
+	require.Nil(t, read)
+	var outOfRange api.ErrOffsetOutOfRange
+	require.True(t, errors.As(err, &outOfRange), "got %v", err)
+	require.Equal(t, first+3, outOfRange.Offset)
+	closeLog(t, l)
+}
+
+func testConcurrent(t *testing.T, _ Harness, l CommitLog) {
+	const writers, records = 4, 25
+	first := appendN(t, l, 1)
+	var wg sync.WaitGroup
+	offsets := make(chan uint64, writers*records)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				offset, err := l.Append(&api.Record{Value: value(w*records + i)})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				offsets <- offset
+				// Everything up to a returned offset is readable
+				if _, err = l.Read(offset); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err = l.Read(first); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(offsets)
+
+	seen := make(map[uint64]bool)
+	for offset := range offsets {
+		require.False(t, seen[offset], "offset %d assigned twice", offset)
+		seen[offset] = true
+	}
+	require.Equal(t, writers*records, len(seen))
+	for i := uint64(1); i <= writers*records; i++ {
+		require.True(t, seen[first+i], "offset %d skipped", first+i)
+		read, err := l.Read(first + i)
+		require.NoError(t, err)
+		require.Equal(t, first+i, read.Offset)
+	}
+	closeLog(t, l)
+}
+
+func testRestart(t *testing.T, h Harness, l CommitLog) {
+	if h.Reopen == nil {
+		t.Skip("log isn't durable")
+	}
+	first := appendN(t, l, 10)
+	l = h.Reopen(t, l)
+	requireRecords(t, l, first, first, first+10)
+	require.Equal(t, first+10, appendN(t, l, 1))
+	closeLog(t, l)
+}
+
+func testTruncate(t *testing.T, _ Harness, l CommitLog) {
+	tl, ok := l.(Truncater)
+	if !ok {
+		t.Skip("log doesn't support truncation")
+	}
+	first := appendN(t, l, 10)
+	require.NoError(t, tl.Truncate(first+4))
+	lowest, err := tl.LowestOffset()
+	require.NoError(t, err)
+	require.LessOrEqual(t, lowest, first+5)
+	requireRecords(t, l, first, first+5, first+10)
+	if lowest > first {
+		_, err = l.Read(lowest - 1)
+		require.True(t, errors.As(err, &api.ErrOffsetOutOfRange{}), "got %v", err)
+	}
+	require.Equal(t, first+10, appendN(t, l, 1))
+	closeLog(t, l)
+}
+
+func testTruncateAfter(t *testing.T, _ Harness, l CommitLog) {
+	tl, ok := l.(TailTruncater)
+	if !ok {
+		t.Skip("log doesn't support truncating its tail")
+	}
+	first := appendN(t, l, 10)
+	require.NoError(t, tl.TruncateAfter(first+4))
+	highest, err := tl.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, first+4, highest)
+	_, err = l.Read(first + 5)
+	require.True(t, errors.As(err, &api.ErrOffsetOutOfRange{}), "got %v", err)
+	requireRecords(t, l, first, first, first+5)
+	// Offsets are reused after the cut
+	require.Equal(t, first+5, appendN(t, l, 1))
+	closeLog(t, l)
+}
+
+func testIdempotentProducer(t *testing.T, h Harness, l CommitLog) {
+	il, ok := l.(IdempotentLog)
+	if !ok {
+		t.Skip("log doesn't deduplicate producers")
+	}
+	id, err := il.InitProducer()
+	require.NoError(t, err)
+	require.NotZero(t, id)
+	produce := func(l CommitLog, seq uint64) (uint64, error) {
+		return l.Append(&api.Record{Value: value(int(seq)), ProducerId: id, Sequence: seq})
+	}
+	first, err := produce(l, 0)
+	require.NoError(t, err)
+	appendN(t, l, 1)
+	offset, err := produce(l, 0)
+	require.NoError(t, err)
+	require.Equal(t, first, offset)
+
+	_, err = produce(l, 2)
+	var outOfOrder api.ErrOutOfOrderSequence
+	require.True(t, errors.As(err, &outOfOrder), "got %v", err)
+	require.Equal(t, uint64(1), outOfOrder.Expected)
+	_, err = l.Append(&api.Record{ProducerId: id + 1})
+	require.True(t, errors.As(err, &api.ErrUnknownProducer{}), "got %v", err)
+
+	if h.Reopen != nil {
+		l = h.Reopen(t, l)
+	}
+	offset, err = produce(l, 0)
+	require.NoError(t, err)
+	require.Equal(t, first, offset)
+	offset, err = produce(l, 1)
+	require.NoError(t, err)
+	require.Equal(t, first+2, offset)
+	if il, ok := l.(IdempotentLog); ok {
+		next, err := il.InitProducer()
+		require.NoError(t, err)
+		require.NotEqual(t, id, next)
+	}
+	closeLog(t, l)
+}
+
+func testConditionalAppend(t *testing.T, _ Harness, l CommitLog) {
+	cl, ok := l.(ConditionalLog)
+	if !ok {
+		t.Skip("log doesn't support conditional appends")
+	}
+	first := appendN(t, l, 2)
+	_, err := cl.AppendAt(first+1, &api.Record{Value: value(2)})
+	var unexpected api.ErrUnexpectedOffset
+	require.True(t, errors.As(err, &unexpected), "got %v", err)
+	require.Equal(t, api.ErrUnexpectedOffset{Expected: first + 1, Actual: first + 2}, unexpected)
+
+	offset, err := cl.AppendAt(first+2, &api.Record{Value: value(2)})
+	require.NoError(t, err)
+	require.Equal(t, first+2, offset)
+	requireRecords(t, l, first, first, first+3)
+
+	// Of concurrent writers expecting the same offset only one succeeds
+	const writers = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cl.AppendAt(first+3, &api.Record{Value: value(3)})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	var succeeded int
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else {
+			require.True(t, errors.As(err, &api.ErrUnexpectedOffset{}), "got %v", err)
+		}
+	}
+	require.Equal(t, 1, succeeded)
+	requireRecords(t, l, first, first, first+4)
+	closeLog(t, l)
+}
+
+func testStreams(t *testing.T, h Harness, l CommitLog) {
+	if _, ok := l.(StreamLog); !ok {
+		t.Skip("log doesn't index streams")
+	}
+	var offsets []uint64
+	for i := 0; i < 6; i++ {
+		rec := &api.Record{Key: fmt.Sprintf("stream-%d", i%2), Value: value(i)}
+		offset, err := l.Append(rec)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i/2), rec.Version)
+		offsets = append(offsets, offset)
+	}
+	appendN(t, l, 1)
+	if h.Reopen != nil {
+		l = h.Reopen(t, l)
+	}
+	sl := l.(StreamLog)
+	requireStream(t, sl, "stream-0", 0, offsets[0], offsets[2], offsets[4])
+	requireStream(t, sl, "stream-1", 1, offsets[3], offsets[5])
+	requireStream(t, sl, "stream-1", 3)
+	requireStream(t, sl, "stream-2", 0)
+	read, err := l.Read(offsets[5])
+	require.NoError(t, err)
+	require.Equal(t, "stream-1", read.Key)
+	require.Equal(t, uint64(2), read.Version)
+
+	_, err = sl.AppendVersion(2, &api.Record{Key: "stream-0"})
+	var unexpected api.ErrUnexpectedVersion
+	require.True(t, errors.As(err, &unexpected), "got %v", err)
+	require.Equal(t, api.ErrUnexpectedVersion{Key: "stream-0", Expected: 2, Actual: 3}, unexpected)
+	offset, err := sl.AppendVersion(3, &api.Record{Key: "stream-0"})
+	require.NoError(t, err)
+	requireStream(t, sl, "stream-0", 3, offset)
+	_, err = sl.AppendVersion(0, &api.Record{Key: "stream-2"})
+	require.NoError(t, err)
+
+	// Truncating a stream's newest records hands their versions out again
+	if tl, ok := l.(TailTruncater); ok {
+		require.NoError(t, tl.TruncateAfter(offset-1))
+		offset, err = sl.AppendVersion(3, &api.Record{Key: "stream-0"})
+		require.NoError(t, err)
+		requireStream(t, sl, "stream-0", 3, offset)
+	}
+	// but truncating its oldest doesn't, even once they're all gone
+	if tl, ok := l.(Truncater); ok {
+		require.NoError(t, tl.Truncate(offset))
+		if h.Reopen != nil {
+			l = h.Reopen(t, l)
+			sl = l.(StreamLog)
+		}
+		_, err = sl.AppendVersion(0, &api.Record{Key: "stream-1"})
+		require.True(t, errors.As(err, &unexpected), "got %v", err)
+		require.Equal(t, uint64(3), unexpected.Actual)
+	}
+	closeLog(t, l)
+}
+
+func requireStream(t *testing.T, l StreamLog, key string, from uint64, offsets ...uint64) {
+	t.Helper()
+	got, err := l.StreamOffsets(key, from)
+	require.NoError(t, err)
+	if len(offsets) == 0 {
+		require.Empty(t, got)
+		return
+	}
+	require.Equal(t, offsets, got)
+}
+
+func testReadCommitted(t *testing.T, h Harness, l CommitLog) {
+	if _, ok := l.(CommittedReader); !ok {
+		t.Skip("log doesn't support read committed")
+	}
+	write := func(l CommitLog, txn uint64, typ api.RecordType) uint64 {
+		t.Helper()
+		offset, err := l.Append(&api.Record{TxnId: txn, Type: typ})
+		require.NoError(t, err)
+		return offset
+	}
+	committed := write(l, 1, api.RecordType_DATA)
+	aborted := write(l, 2, api.RecordType_DATA)
+	open := write(l, 3, api.RecordType_DATA)
+	write(l, 1, api.RecordType_COMMIT)
+	write(l, 2, api.RecordType_ABORT)
+	plain := appendN(t, l, 1)
+	if h.Reopen != nil {
+		l = h.Reopen(t, l)
+	}
+	cr := l.(CommittedReader)
+
+	rec, err := cr.ReadCommitted(committed)
+	require.NoError(t, err)
+	require.Equal(t, committed, rec.Offset)
+	// Nothing from the open transaction's first record onwards is visible
+	_, err = cr.ReadCommitted(aborted)
+	require.True(t, errors.As(err, &api.ErrOffsetOutOfRange{}), "got %v", err)
+
+	write(l, 3, api.RecordType_COMMIT)
+	rec, err = cr.ReadCommitted(aborted)
+	require.NoError(t, err)
+	require.Equal(t, open, rec.Offset)
+	rec, err = cr.ReadCommitted(open + 1)
+	require.NoError(t, err)
+	require.Equal(t, plain, rec.Offset)
+	_, err = cr.ReadCommitted(plain + 1)
+	require.True(t, errors.As(err, &api.ErrOffsetOutOfRange{}), "got %v", err)
+	closeLog(t, l)
+}
+
+func testTimestamps(t *testing.T, h Harness, l CommitLog) {
+	if _, ok := l.(TimestampLog); !ok {
+		t.Skip("log doesn't look up timestamps")
+	}
+	var offsets []uint64
+	var timestamps []int64
+	for i := 0; i < 3; i++ {
+		rec := &api.Record{Value: value(i)}
+		offset, err := l.Append(rec)
+		require.NoError(t, err)
+		require.NotZero(t, rec.Timestamp)
+		offsets = append(offsets, offset)
+		timestamps = append(timestamps, rec.Timestamp)
+		// The next record is appended a millisecond later
+		time.Sleep(2 * time.Millisecond)
+	}
+	if h.Reopen != nil {
+		l = h.Reopen(t, l)
+	}
+	tl := l.(TimestampLog)
+	read, err := l.Read(offsets[1])
+	require.NoError(t, err)
+	require.Equal(t, timestamps[1], read.Timestamp)
+
+	for i, timestamp := range timestamps {
+		offset, err := tl.OffsetAt(timestamp)
+		require.NoError(t, err)
+		require.Equal(t, offsets[i], offset)
+	}
+	offset, err := tl.OffsetAt(0)
+	require.NoError(t, err)
+	require.Equal(t, offsets[0], offset)
+	offset, err = tl.OffsetAt(timestamps[2] + 1)
+	require.NoError(t, err)
+	require.Equal(t, offsets[2]+1, offset)
+	closeLog(t, l)
+}
+
+// appendN appends n records and returns the first one's offset.
+func appendN(t *testing.T, l CommitLog, n int) uint64 {
+	t.Helper()
+	var first uint64
+	for i := 0; i < n; i++ {
+		offset, err := l.Append(&api.Record{Value: value(i)})
+		require.NoError(t, err)
+		if i == 0 {
+			first = offset
+		}
+	}
+	return first
+}
+
+// requireRecords checks that the records in [from, to) are the ones appendN
+// appended starting at first.
+func requireRecords(t *testing.T, l CommitLog, first, from, to uint64) {
+	t.Helper()
+	for offset := from; offset < to; offset++ {
+		read, err := l.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, offset, read.Offset)
+		require.Equal(t, value(int(offset-first)), read.Value)
+	}
+}
+
+func closeLog(t *testing.T, l CommitLog) {
+	t.Helper()
+	if c, ok := l.(interface{ Close() error }); ok {
+		require.NoError(t, c.Close())
+	}
+}
+
+func value(i int) []byte {
+	return []byte(fmt.Sprintf("record %d", i))
+}